@@ -0,0 +1,169 @@
+package autoretry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/crast/dynatools/internal"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// Stop is returned by a BackoffPolicy to signal that no more retries should happen.
+const Stop time.Duration = -1
+
+const (
+	defaultBase     = 10 * time.Millisecond
+	defaultMaxDelay = 5 * time.Second
+
+	// Multiplier used for errors which do not appear in Multipliers.
+	DefaultMultiplier = 2.0
+)
+
+// The default growth factor for each retryable dynago error type.
+var DefaultMultipliers = map[dynago.AmazonError]float64{
+	dynago.ErrorThroughputExceeded: 3,
+	dynago.ErrorThrottling:         3,
+	dynago.ErrorServiceUnavailable: 2,
+	dynago.ErrorInternalFailure:    2,
+}
+
+// DefaultBackoff is used by AutoRetry when no Backoff is set.
+var DefaultBackoff BackoffPolicy = &FullJitter{}
+
+/*
+BackoffPolicy decides how long to wait before each retry.
+
+Implementations must be safe to use from multiple goroutines.
+*/
+type BackoffPolicy interface {
+	// Delay returns how long to wait before the next attempt, or Stop if
+	// we should give up retrying entirely.
+	Delay(state RetryState) time.Duration
+}
+
+// RetryState describes the retry loop at the moment a delay is computed.
+type RetryState struct {
+	Attempt uint          // The retry we are about to make, starting from 1.
+	Elapsed time.Duration // Time spent since the first attempt began.
+	Prev    time.Duration // The previous delay, or 0 before the first retry.
+	Err     error         // The error which caused this retry.
+}
+
+// BackoffConfig holds the settings shared by all the bundled policies.
+type BackoffConfig struct {
+	Base       time.Duration // Initial delay. Defaults to 10ms
+	MaxDelay   time.Duration // Upper bound for any single delay. Defaults to 5s
+	MaxElapsed time.Duration // Give up once this much time has passed. Zero means no limit.
+
+	// Growth factor for each error type. Defaults to DefaultMultipliers.
+	Multipliers map[dynago.AmazonError]float64
+}
+
+func (c *BackoffConfig) base() time.Duration {
+	if c.Base > 0 {
+		return c.Base
+	}
+	return defaultBase
+}
+
+func (c *BackoffConfig) maxDelay() time.Duration {
+	if c.MaxDelay > 0 {
+		return c.MaxDelay
+	}
+	return defaultMaxDelay
+}
+
+func (c *BackoffConfig) multiplier(err error) float64 {
+	multipliers := c.Multipliers
+	if multipliers == nil {
+		multipliers = DefaultMultipliers
+	}
+	if e := internal.AssertError(err); e != nil {
+		if m, ok := multipliers[e.Type]; ok {
+			return m
+		}
+	}
+	return DefaultMultiplier
+}
+
+// Apply the delay cap and the elapsed limit to a computed delay.
+func (c *BackoffConfig) limit(state RetryState, d time.Duration) time.Duration {
+	if max := c.maxDelay(); d > max || d < 0 {
+		d = max
+	}
+	if c.MaxElapsed > 0 && state.Elapsed+d > c.MaxElapsed {
+		return Stop
+	}
+	return d
+}
+
+// The un-jittered exponential ceiling for the given retry attempt.
+func (c *BackoffConfig) ceiling(state RetryState) time.Duration {
+	f := float64(c.base()) * math.Pow(c.multiplier(state.Err), float64(state.Attempt))
+	if f > float64(c.maxDelay()) {
+		return c.maxDelay()
+	}
+	return time.Duration(f)
+}
+
+/*
+Exponential grows the delay by the error's multiplier on every retry, with
+no randomness at all.
+
+This matches the original behaviour of AutoRetry, where a throughput error
+triples the delay and an internal failure doubles it.
+*/
+type Exponential struct {
+	BackoffConfig
+}
+
+func (p *Exponential) Delay(state RetryState) time.Duration {
+	prev := state.Prev
+	if prev <= 0 {
+		prev = p.base()
+	}
+	return p.limit(state, time.Duration(float64(prev)*p.multiplier(state.Err)))
+}
+
+/*
+FullJitter picks a random delay between zero and the exponential ceiling.
+
+This spreads out retries from many clients which failed at the same time,
+and is the best general-purpose choice.
+*/
+type FullJitter struct {
+	BackoffConfig
+}
+
+func (p *FullJitter) Delay(state RetryState) time.Duration {
+	return p.limit(state, randBetween(0, p.ceiling(state)))
+}
+
+/*
+DecorrelatedJitter picks a random delay between the base and the error's
+multiplier times the previous delay.
+
+Successive delays depend on each other rather than on the attempt count,
+which keeps the delays growing while still being spread out.
+*/
+type DecorrelatedJitter struct {
+	BackoffConfig
+}
+
+func (p *DecorrelatedJitter) Delay(state RetryState) time.Duration {
+	prev := state.Prev
+	if prev <= 0 {
+		prev = p.base()
+	}
+	upper := time.Duration(float64(prev) * p.multiplier(state.Err))
+	return p.limit(state, randBetween(p.base(), upper))
+}
+
+// Random duration in the range [low, high)
+func randBetween(low, high time.Duration) time.Duration {
+	if high <= low {
+		return low
+	}
+	return low + time.Duration(rand.Int63n(int64(high-low)))
+}
@@ -0,0 +1,65 @@
+package autoretry
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+var throughputErr = &dynago.Error{Type: dynago.ErrorThroughputExceeded}
+var internalErr = &dynago.Error{Type: dynago.ErrorInternalFailure}
+
+func TestExponential(t *testing.T) {
+	p := &Exponential{BackoffConfig{Base: 10 * time.Millisecond, MaxDelay: time.Second}}
+	seq := []struct {
+		err      error
+		expected time.Duration
+	}{
+		{throughputErr, 30 * time.Millisecond},
+		{internalErr, 60 * time.Millisecond},
+		{throughputErr, 180 * time.Millisecond},
+		{throughputErr, 540 * time.Millisecond},
+		{throughputErr, time.Second},
+	}
+	state := RetryState{}
+	for i, s := range seq {
+		state.Attempt++
+		state.Err = s.err
+		delay := p.Delay(state)
+		if delay != s.expected {
+			t.Errorf("Attempt %d: Expected %v, got %v", i+1, s.expected, delay)
+		}
+		state.Prev = delay
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	conf := BackoffConfig{Base: 10 * time.Millisecond, MaxDelay: 200 * time.Millisecond}
+	full := &FullJitter{conf}
+	decorrelated := &DecorrelatedJitter{conf}
+	state := RetryState{Err: throughputErr}
+	for i := 0; i < 100; i++ {
+		state.Attempt = uint(i%6) + 1
+		if d := full.Delay(state); d < 0 || d > conf.MaxDelay {
+			t.Errorf("FullJitter delay %v out of bounds", d)
+		}
+		d := decorrelated.Delay(state)
+		if d < conf.Base || d > conf.MaxDelay {
+			t.Errorf("DecorrelatedJitter delay %v out of bounds", d)
+		}
+		state.Prev = d
+	}
+}
+
+func TestMaxElapsed(t *testing.T) {
+	p := &Exponential{BackoffConfig{MaxElapsed: time.Second}}
+	state := RetryState{Attempt: 1, Elapsed: 990 * time.Millisecond, Err: throughputErr}
+	if d := p.Delay(state); d != Stop {
+		t.Errorf("Expected Stop, got %v", d)
+	}
+	state.Elapsed = 0
+	if d := p.Delay(state); d != 30*time.Millisecond {
+		t.Errorf("Expected 30ms, got %v", d)
+	}
+}
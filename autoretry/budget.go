@@ -0,0 +1,72 @@
+package autoretry
+
+import "sync"
+
+/*
+Budget is a token bucket which limits how many retries may happen.
+
+A single Budget can be shared between any number of AutoRetry instances and
+bulk writers. Every retry spends one token, and every successful request
+earns back a fraction of a token. When the bucket is empty, retries stop and
+the original error is returned immediately, so that a struggling table is not
+buried under a storm of retries.
+
+A nil *Budget allows unlimited retries.
+*/
+type Budget struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	credit float64
+}
+
+/*
+Create a new retry budget.
+
+max is the most tokens the bucket can hold (and the number it starts with),
+credit is how many tokens each successful request earns back.
+*/
+func NewBudget(max, credit float64) *Budget {
+	return &Budget{
+		tokens: max,
+		max:    max,
+		credit: credit,
+	}
+}
+
+// Withdraw spends a token for a retry, returning false if none are left.
+func (b *Budget) Withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Deposit refills the bucket after a successful request.
+func (b *Budget) Deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens += b.credit
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+	b.mu.Unlock()
+}
+
+// Tokens returns how many tokens are currently available.
+func (b *Budget) Tokens() float64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
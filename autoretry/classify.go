@@ -0,0 +1,43 @@
+package autoretry
+
+import (
+	"context"
+	"errors"
+
+	"github.com/crast/dynatools/internal"
+)
+
+/*
+Classifier decides whether a failed request is worth retrying.
+
+A custom Classifier can wrap Retryable to add or remove cases:
+
+	r.Classify = func(err error) bool {
+		return err != errMyPermanent && autoretry.Retryable(err)
+	}
+*/
+type Classifier func(err error) bool
+
+/*
+Retryable is the default Classifier.
+
+It retries dynago throttling and service errors, the transient transport
+errors recognized by IsTransient, and attempts cut short by AttemptTimeout.
+Wrapped errors are recognized too.
+*/
+func Retryable(err error) bool {
+	// Only an attempt can have timed out, as the caller's context is checked first.
+	return errors.Is(err, context.DeadlineExceeded) || internal.IsRetryable(err)
+}
+
+/*
+IsTransient reports whether err is a transport error which may well succeed
+if the request is tried again.
+
+This covers network timeouts, connection resets and refusals, connections
+closed mid-response (EOF) and broken TLS handshakes. Errors wrapped by
+*url.Error or *net.OpError are unwrapped.
+*/
+func IsTransient(err error) bool {
+	return internal.IsTransient(err)
+}
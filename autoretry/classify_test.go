@@ -0,0 +1,86 @@
+package autoretry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+func TestRetryable(t *testing.T) {
+	reset := &url.Error{Op: "Post", URL: "https://dynamodb", Err: &net.OpError{
+		Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET),
+	}}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	cases := []struct {
+		err      error
+		expected bool
+	}{
+		{throughputErr, true},
+		{&dynago.Error{Type: dynago.ErrorThrottling}, true},
+		{&dynago.Error{Type: dynago.ErrorConditionFailed}, false},
+		{&dynago.Error{Type: dynago.ErrorValidation}, false},
+		{io.EOF, true},
+		{&url.Error{Op: "Post", URL: "https://dynamodb", Err: io.ErrUnexpectedEOF}, true},
+		{reset, true},
+		{refused, true},
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("attempt: %w", context.DeadlineExceeded), true},
+		{errors.New("something else"), false},
+		{nil, false},
+	}
+	for i, c := range cases {
+		if result := Retryable(c.err); result != c.expected {
+			t.Errorf("Case %d (%v): Expected %v, got %v", i, c.err, c.expected, result)
+		}
+	}
+}
+
+func TestCustomClassifier(t *testing.T) {
+	requester := &scriptedRequester{errs: []error{io.EOF}}
+	r := &AutoRetry{
+		Requester:  requester,
+		MaxRetries: 3,
+		Backoff:    fastBackoff,
+		Classify:   func(err error) bool { return err != io.EOF && Retryable(err) },
+	}
+	if _, err := r.MakeRequest("DynamoDB_20120810.GetItem", nil); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+	if requester.calls != 1 {
+		t.Errorf("Expected 1 call, got %d", requester.calls)
+	}
+}
+
+// Attempt timeouts go through the classifier like any other error.
+func TestClassifierSeesTimeouts(t *testing.T) {
+	requester := &scriptedRequester{errs: []error{context.DeadlineExceeded}}
+	r := &AutoRetry{
+		Requester:  requester,
+		MaxRetries: 3,
+		Backoff:    fastBackoff,
+		Classify:   func(err error) bool { return !errors.Is(err, context.DeadlineExceeded) && Retryable(err) },
+	}
+	if _, err := r.MakeRequest("DynamoDB_20120810.UpdateItem", nil); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if requester.calls != 1 {
+		t.Errorf("Expected 1 call, got %d", requester.calls)
+	}
+
+	requester.calls = 0
+	r.Classify = nil
+	if _, err := r.MakeRequest("DynamoDB_20120810.UpdateItem", nil); err != nil {
+		t.Errorf("Expected the timeout retried by default, got %v", err)
+	}
+	if requester.calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", requester.calls)
+	}
+}
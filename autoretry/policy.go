@@ -0,0 +1,59 @@
+package autoretry
+
+import (
+	"time"
+
+	"github.com/crast/dynatools/internal"
+)
+
+/*
+Policy overrides how AutoRetry behaves for a single operation.
+
+Unset Backoff, Classify and AttemptTimeout fields fall back to the settings
+on the AutoRetry itself, but MaxRetries is always taken as-is, so a zero
+Policy disables retries for its operation:
+
+	retry.Policies = map[string]*autoretry.Policy{
+		"GetItem":    {MaxRetries: 10},
+		"UpdateItem": {}, // ADD expressions are not safe to repeat
+	}
+*/
+type Policy struct {
+	MaxRetries     uint
+	Backoff        BackoffPolicy
+	Classify       Classifier
+	AttemptTimeout time.Duration
+}
+
+// Work out the effective policy for a target, filling in defaults.
+func (r *AutoRetry) policyFor(target string) Policy {
+	p := Policy{
+		MaxRetries:     r.MaxRetries,
+		Backoff:        r.Backoff,
+		Classify:       r.Classify,
+		AttemptTimeout: r.AttemptTimeout,
+	}
+	override := r.Policies[target]
+	if override == nil {
+		override = r.Policies[internal.Operation(target)]
+	}
+	if override != nil {
+		p.MaxRetries = override.MaxRetries
+		if override.Backoff != nil {
+			p.Backoff = override.Backoff
+		}
+		if override.Classify != nil {
+			p.Classify = override.Classify
+		}
+		if override.AttemptTimeout > 0 {
+			p.AttemptTimeout = override.AttemptTimeout
+		}
+	}
+	if p.Backoff == nil {
+		p.Backoff = DefaultBackoff
+	}
+	if p.Classify == nil {
+		p.Classify = Retryable
+	}
+	return p
+}
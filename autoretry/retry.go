@@ -1,41 +1,198 @@
 // Dynago has no retry logic currently, this is a way to test out auto-retry logic.
 package autoretry
 
-import "time"
-import "gopkg.in/underarmour/dynago.v1"
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/crast/dynatools/internal"
+	"github.com/crast/dynatools/middleware"
+	"github.com/crast/dynatools/tracing"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+/*
+AutoRetry wraps an AwsRequester, retrying requests which fail with
+throttling or transient service errors.
+
+Between attempts it sleeps for a duration chosen by the Backoff policy.
+*/
 type AutoRetry struct {
 	Requester  dynago.AwsRequester
-	MaxRetries uint // Maximum number of retries.
+	MaxRetries uint          // Maximum number of retries.
+	Backoff    BackoffPolicy // How long to wait between attempts. Defaults to DefaultBackoff
+	Classify   Classifier    // Which errors are worth retrying. Defaults to Retryable
+
+	// If set, each individual attempt is abandoned after this long and
+	// then retried like any other transient failure.
+	AttemptTimeout time.Duration
+
+	// Optional retry budget, which may be shared with other AutoRetry
+	// instances. Once it runs dry the original error is returned right away.
+	Budget *Budget
+
+	// Per-operation overrides, keyed either by operation name like
+	// "UpdateItem" or by the full target. Operations without an entry use
+	// the settings above.
+	Policies map[string]*Policy
+
+	// Optional tracer, recording a span for each request with a child span
+	// for each attempt at it.
+	Tracer *tracing.Tracer
 }
 
 func (r *AutoRetry) MakeRequest(target string, body []byte) (response []byte, err error) {
-	backoff := 10 * time.Millisecond
-	for i := r.MaxRetries; i > 0; i-- {
-		response, err = r.Requester.MakeRequest(target, body)
+	return r.MakeRequestContext(context.Background(), target, body)
+}
+
+/*
+MakeRequestContext is like MakeRequest, but gives up as soon as ctx is done.
+
+If the context ends before a request succeeds, the error returned is a
+*CanceledError wrapping both the context error and the last dynago error.
+
+If the wrapped Requester has a MakeRequestContext method of its own, it is
+given a context carrying the per-attempt timeout.
+*/
+func (r *AutoRetry) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return r.makeRequest(ctx, r.Requester, target, body)
+}
+
+func (r *AutoRetry) makeRequest(ctx context.Context, requester dynago.AwsRequester, target string, body []byte) (response []byte, err error) {
+	ctx, span := r.startSpan(ctx, internal.Operation(target), target, body)
+	defer func() { endSpan(span, err) }()
+
+	policy := r.policyFor(target)
+	start := time.Now()
+	state := RetryState{}
+	var last *dynago.Error
+	for {
+		attemptCtx, attemptSpan := r.startSpan(ctx, "attempt", target, body)
+		attemptSpan.SetAttr(tracing.AttrAttempt, int(state.Attempt+1))
+		response, err = policy.attempt(internal.WithAttempt(attemptCtx, state.Attempt+1), requester, target, body)
+		endSpan(attemptSpan, err)
+		if e := internal.AssertError(err); e != nil {
+			last = e
+		}
 		if err == nil {
+			r.Budget.Deposit()
+			return
+		} else if ctx.Err() != nil {
+			return nil, &CanceledError{Err: ctx.Err(), Last: last}
+		} else if state.Attempt >= policy.MaxRetries || !policy.Classify(err) {
+			return
+		}
+		state.Attempt++
+		state.Elapsed = time.Since(start)
+		state.Err = err
+		delay := policy.Backoff.Delay(state)
+		if delay == Stop || !r.Budget.Withdraw() {
 			return
-		} else if e, ok := err.(*dynago.Error); !ok {
-			break
-		} else {
-			switch e.Type {
-			case dynago.ErrorThroughputExceeded, dynago.ErrorThrottling:
-				backoff *= 3
-			case dynago.ErrorServiceUnavailable, dynago.ErrorInternalFailure:
-				backoff *= 2
-			default:
-				return
-			}
 		}
+		if !sleep(ctx, delay) {
+			return nil, &CanceledError{Err: ctx.Err(), Last: last}
+		}
+		state.Prev = delay
+	}
+}
+
+/*
+Attempt returns which try of a request is being made, starting from 1, when
+called with the context a wrapped requester's MakeRequestContext was given.
+It returns 0 for requests which are not being made by an AutoRetry.
+*/
+func Attempt(ctx context.Context) uint {
+	return internal.AttemptFrom(ctx)
+}
+
+func (r *AutoRetry) startSpan(ctx context.Context, name, target string, body []byte) (context.Context, *tracing.Span) {
+	if r.Tracer == nil {
+		return ctx, nil
 	}
-	return
+	ctx, span := r.Tracer.Start(ctx, name)
+	span.SetAttr(tracing.AttrTarget, target)
+	span.SetAttr(tracing.AttrTable, strings.Join(internal.TableNames(body), ","))
+	return ctx, span
 }
 
-func (r *AutoRetry) Install(e Executor) {
-	var requester dynago.AwsRequester = r
-	awsExec := e.(*dynago.AwsExecutor)
-	if awsExec.Requester != requester {
-		r.Requester = awsExec.Requester
-		awsExec.Requester = r
+func endSpan(span *tracing.Span, err error) {
+	if err != nil {
+		span.SetAttr(tracing.AttrErrorType, internal.ErrorType(err))
 	}
+	span.End(err)
+}
+
+func (p Policy) attempt(ctx context.Context, requester dynago.AwsRequester, target string, body []byte) ([]byte, error) {
+	if p.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.AttemptTimeout)
+		defer cancel()
+	}
+	return internal.MakeRequest(ctx, requester, target, body)
+}
+
+// Sleep for d, returning false if ctx was done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// CanceledError is returned when the context ends before a request succeeds.
+type CanceledError struct {
+	Err  error         // The error from the context.
+	Last *dynago.Error // The last dynago error we got before giving up, if any.
+}
+
+func (e *CanceledError) Error() string {
+	if e.Last != nil {
+		return fmt.Sprintf("autoretry: %v (last error: %v)", e.Err, e.Last)
+	}
+	return fmt.Sprintf("autoretry: %v", e.Err)
+}
+
+// Unwrap allows errors.Is and errors.As to see both wrapped errors.
+func (e *CanceledError) Unwrap() []error {
+	if e.Last != nil {
+		return []error{e.Err, e.Last}
+	}
+	return []error{e.Err}
+}
+
+/*
+Middleware returns a layer which applies this AutoRetry's settings to the
+requester it wraps. The Requester field is ignored by the returned layer.
+*/
+func (r *AutoRetry) Middleware() middleware.Middleware {
+	return func(next dynago.AwsRequester) dynago.AwsRequester {
+		return &layer{r, next}
+	}
+}
+
+// Install to the executor as the "autoretry" layer of its middleware chain.
+func (r *AutoRetry) Install(e *dynago.AwsExecutor) {
+	middleware.Install(e).Use(Name, r.Middleware())
+}
+
+// The name AutoRetry uses for itself in a middleware chain.
+const Name = "autoretry"
+
+type layer struct {
+	retry *AutoRetry
+	next  dynago.AwsRequester
+}
+
+func (l *layer) MakeRequest(target string, body []byte) ([]byte, error) {
+	return l.retry.makeRequest(context.Background(), l.next, target, body)
+}
+
+func (l *layer) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return l.retry.makeRequest(ctx, l.next, target, body)
 }
@@ -0,0 +1,189 @@
+package autoretry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/crast/dynatools/tracing"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// Returns each of errs in turn, then succeeds.
+type scriptedRequester struct {
+	errs  []error
+	calls int
+}
+
+func (s *scriptedRequester) MakeRequest(target string, body []byte) ([]byte, error) {
+	s.calls++
+	if s.calls <= len(s.errs) {
+		return nil, s.errs[s.calls-1]
+	}
+	return []byte("{}"), nil
+}
+
+var fastBackoff = &Exponential{BackoffConfig{Base: time.Microsecond}}
+
+func TestRetriesUntilSuccess(t *testing.T) {
+	requester := &scriptedRequester{errs: []error{throughputErr, internalErr}}
+	r := &AutoRetry{Requester: requester, MaxRetries: 3, Backoff: fastBackoff}
+	_, err := r.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if requester.calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", requester.calls)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	requester := &scriptedRequester{errs: []error{throughputErr, throughputErr, throughputErr}}
+	r := &AutoRetry{Requester: requester, MaxRetries: 1, Backoff: fastBackoff}
+	_, err := r.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	if err != throughputErr {
+		t.Errorf("Expected throughput error, got %v", err)
+	}
+	if requester.calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", requester.calls)
+	}
+}
+
+func TestPermanentErrorNotRetried(t *testing.T) {
+	requester := &scriptedRequester{errs: []error{&dynago.Error{Type: dynago.ErrorConditionFailed}}}
+	r := &AutoRetry{Requester: requester, MaxRetries: 3, Backoff: fastBackoff}
+	r.MakeRequest("DynamoDB_20120810.PutItem", nil)
+	if requester.calls != 1 {
+		t.Errorf("Expected 1 call, got %d", requester.calls)
+	}
+}
+
+func TestContextCancelledDuringBackoff(t *testing.T) {
+	requester := &scriptedRequester{errs: []error{throughputErr, throughputErr}}
+	r := &AutoRetry{
+		Requester:  requester,
+		MaxRetries: 5,
+		Backoff:    &Exponential{BackoffConfig{Base: time.Hour, MaxDelay: time.Hour}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := r.MakeRequestContext(ctx, "DynamoDB_20120810.GetItem", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	var e *dynago.Error
+	if !errors.As(err, &e) || e != throughputErr {
+		t.Errorf("Expected to find the throughput error, got %v", err)
+	}
+	if requester.calls != 1 {
+		t.Errorf("Expected 1 call, got %d", requester.calls)
+	}
+}
+
+func TestBudgetExhausted(t *testing.T) {
+	budget := NewBudget(1, 0.5)
+	requester := &scriptedRequester{errs: []error{throughputErr, throughputErr, throughputErr}}
+	r := &AutoRetry{Requester: requester, MaxRetries: 5, Backoff: fastBackoff, Budget: budget}
+	_, err := r.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	if err != throughputErr {
+		t.Errorf("Expected throughput error, got %v", err)
+	}
+	if requester.calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", requester.calls)
+	}
+
+	// Two successes should earn back enough for one more retry.
+	requester.errs = nil
+	r.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	r.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	if budget.Tokens() != 1 {
+		t.Errorf("Expected 1 token, got %v", budget.Tokens())
+	}
+}
+
+func TestPerOperationPolicy(t *testing.T) {
+	requester := &scriptedRequester{errs: []error{throughputErr, throughputErr, throughputErr}}
+	r := &AutoRetry{
+		Requester:  requester,
+		MaxRetries: 5,
+		Backoff:    fastBackoff,
+		Policies: map[string]*Policy{
+			"UpdateItem":                     {},
+			"DynamoDB_20120810.BatchGetItem": {MaxRetries: 1},
+		},
+	}
+	r.MakeRequest("DynamoDB_20120810.UpdateItem", nil)
+	if requester.calls != 1 {
+		t.Errorf("UpdateItem: Expected 1 call, got %d", requester.calls)
+	}
+
+	requester.calls = 0
+	r.MakeRequest("DynamoDB_20120810.BatchGetItem", nil)
+	if requester.calls != 2 {
+		t.Errorf("BatchGetItem: Expected 2 calls, got %d", requester.calls)
+	}
+
+	requester.calls = 0
+	if _, err := r.MakeRequest("DynamoDB_20120810.GetItem", nil); err != nil {
+		t.Errorf("GetItem: Unexpected error %v", err)
+	}
+	if requester.calls != 4 {
+		t.Errorf("GetItem: Expected 4 calls, got %d", requester.calls)
+	}
+}
+
+// Records the attempt number it sees for each request.
+type attemptRecorder struct {
+	scriptedRequester
+	attempts []uint
+}
+
+func (a *attemptRecorder) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	a.attempts = append(a.attempts, Attempt(ctx))
+	return a.MakeRequest(target, body)
+}
+
+func TestAttemptInContext(t *testing.T) {
+	requester := &attemptRecorder{scriptedRequester: scriptedRequester{errs: []error{throughputErr, throughputErr}}}
+	r := &AutoRetry{Requester: requester, MaxRetries: 3, Backoff: fastBackoff}
+	r.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	if len(requester.attempts) != 3 || requester.attempts[0] != 1 || requester.attempts[2] != 3 {
+		t.Errorf("Expected attempts 1, 2, 3, got %v", requester.attempts)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := &tracing.MemoryExporter{}
+	requester := &scriptedRequester{errs: []error{throughputErr}}
+	r := &AutoRetry{
+		Requester:  requester,
+		MaxRetries: 3,
+		Backoff:    fastBackoff,
+		Tracer:     &tracing.Tracer{Exporter: exporter},
+	}
+	_, err := r.MakeRequest("DynamoDB_20120810.GetItem", []byte(`{"TableName":"users"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	roots := exporter.Roots()
+	if len(roots) != 1 || roots[0].Name != "GetItem" {
+		t.Fatalf("Expected one GetItem span, got %v", roots)
+	}
+	if table := roots[0].Attr(tracing.AttrTable); table != "users" {
+		t.Errorf("Expected table users, got %v", table)
+	}
+	attempts := exporter.Children(roots[0])
+	if len(attempts) != 2 {
+		t.Fatalf("Expected 2 attempt spans, got %d", len(attempts))
+	}
+	if attempts[0].Err != throughputErr || attempts[0].Attr(tracing.AttrAttempt) != 1 {
+		t.Errorf("Unexpected first attempt %+v", attempts[0])
+	}
+	if attempts[0].Attr(tracing.AttrErrorType) == nil {
+		t.Errorf("Expected an error type on the first attempt")
+	}
+	if attempts[1].Err != nil || attempts[1].Attr(tracing.AttrAttempt) != 2 {
+		t.Errorf("Unexpected second attempt %+v", attempts[1])
+	}
+}
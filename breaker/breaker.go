@@ -0,0 +1,297 @@
+/*
+package breaker implements a circuit breaker for dynago requesters.
+
+When DynamoDB is having trouble, continuing to send it requests mostly just
+adds latency to every caller. A Breaker wraps an AwsRequester, and once too
+many requests fail with service-unavailable or internal-failure errors, it
+"opens" and fails every request immediately with an *OpenError.
+
+After OpenTimeout has passed, the breaker goes half-open and lets a few probe
+requests through. If they all succeed the breaker closes again, otherwise it
+goes back to being open.
+
+Usage:
+
+	b := &breaker.Breaker{
+		OnStateChange: func(from, to breaker.State) {
+			log.Printf("DynamoDB circuit breaker %s -> %s", from, to)
+		},
+	}
+	b.Install(executor)
+*/
+package breaker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/crast/dynatools/internal"
+	"github.com/crast/dynatools/middleware"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+type State int
+
+const (
+	Closed   State = iota // Requests flow normally.
+	Open                  // Requests fail immediately.
+	HalfOpen              // A limited number of probe requests are let through.
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// OpenError is returned for requests rejected while the breaker is open.
+type OpenError struct {
+	Target string    // The target of the rejected request.
+	Until  time.Time // When the breaker will next let a probe through.
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("breaker: circuit open, rejected %s until %s", e.Target, e.Until.Format(time.RFC3339))
+}
+
+/*
+Breaker is a circuit breaker wrapping an AwsRequester.
+
+All the settings are optional, and must not be changed once requests are
+flowing through the breaker.
+*/
+type Breaker struct {
+	Requester dynago.AwsRequester
+
+	// Open once this fraction of requests in a window have failed.
+	FailureRate float64 // Defaults to 0.5
+
+	// Don't consider the failure rate until a window has seen this many requests.
+	MinRequests int // Defaults to 20
+
+	// Failures are counted over consecutive windows of this length.
+	Window time.Duration // Defaults to 10 seconds
+
+	// How long to stay open before letting probe requests through.
+	OpenTimeout time.Duration // Defaults to 5 seconds
+
+	// How many probes must succeed in a row in the half-open state to close.
+	Probes int // Defaults to 1
+
+	// Decides which errors count as failures. Defaults to IsFailure
+	IsFailure func(err error) bool
+
+	// Called, outside of any lock, whenever the state changes.
+	OnStateChange func(from, to State)
+
+	mu          sync.Mutex
+	state       State
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     int // Probes currently in flight
+	probesOK    int // Probes which have succeeded
+}
+
+/*
+IsFailure is the default test for failures: service-unavailable and
+internal-failure errors are counted, everything else (including errors like
+a failed condition) is a sign that DynamoDB is up and answering.
+*/
+func IsFailure(err error) bool {
+	return internal.IsServiceError(err)
+}
+
+func (b *Breaker) MakeRequest(target string, body []byte) ([]byte, error) {
+	return b.MakeRequestContext(context.Background(), target, body)
+}
+
+// MakeRequestContext is like MakeRequest, passing ctx on to the wrapped requester.
+func (b *Breaker) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return b.makeRequest(ctx, b.Requester, target, body)
+}
+
+func (b *Breaker) makeRequest(ctx context.Context, requester dynago.AwsRequester, target string, body []byte) ([]byte, error) {
+	probe, err := b.before(target)
+	if err != nil {
+		return nil, err
+	}
+	response, err := internal.MakeRequest(ctx, requester, target, body)
+	b.after(probe, err)
+	return response, err
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	from := b.state
+	b.checkTimeout(time.Now())
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+	return to
+}
+
+/*
+Middleware returns a layer which runs requests through this breaker. Every
+layer made from the same Breaker shares its state.
+*/
+func (b *Breaker) Middleware() middleware.Middleware {
+	return func(next dynago.AwsRequester) dynago.AwsRequester {
+		return &layer{b, next}
+	}
+}
+
+// Install to the executor as the "breaker" layer of its middleware chain.
+func (b *Breaker) Install(executor *dynago.AwsExecutor) {
+	middleware.Install(executor).Use(Name, b.Middleware())
+}
+
+// The name Breaker uses for itself in a middleware chain.
+const Name = "breaker"
+
+type layer struct {
+	breaker *Breaker
+	next    dynago.AwsRequester
+}
+
+func (l *layer) MakeRequest(target string, body []byte) ([]byte, error) {
+	return l.breaker.makeRequest(context.Background(), l.next, target, body)
+}
+
+func (l *layer) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return l.breaker.makeRequest(ctx, l.next, target, body)
+}
+
+// Decide whether a request may proceed, and whether it is a probe.
+func (b *Breaker) before(target string) (probe bool, err error) {
+	now := time.Now()
+	b.mu.Lock()
+	from := b.state
+	b.checkTimeout(now)
+	switch b.state {
+	case Open:
+		err = &OpenError{Target: target, Until: b.openedAt.Add(b.openTimeout())}
+	case HalfOpen:
+		if b.probing+b.probesOK < b.probes() {
+			b.probing++
+			probe = true
+		} else {
+			err = &OpenError{Target: target, Until: now}
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+	return
+}
+
+// Record the outcome of a request.
+func (b *Breaker) after(probe bool, err error) {
+	isFailure := b.IsFailure
+	if isFailure == nil {
+		isFailure = IsFailure
+	}
+	failed := err != nil && isFailure(err)
+	now := time.Now()
+
+	b.mu.Lock()
+	from := b.state
+	if probe {
+		b.probing--
+		if b.state == HalfOpen {
+			if failed {
+				b.trip(now)
+			} else if b.probesOK++; b.probesOK >= b.probes() {
+				b.state = Closed
+				b.resetWindow(now)
+			}
+		}
+	} else if b.state == Closed {
+		if now.Sub(b.windowStart) > b.window() {
+			b.resetWindow(now)
+		}
+		b.requests++
+		if failed {
+			b.failures++
+			if b.requests >= b.minRequests() && float64(b.failures) >= b.failureRate()*float64(b.requests) {
+				b.trip(now)
+			}
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+}
+
+// Must hold the lock.
+func (b *Breaker) checkTimeout(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.openTimeout() {
+		b.state = HalfOpen
+		b.probesOK = 0
+	}
+}
+
+// Must hold the lock.
+func (b *Breaker) trip(now time.Time) {
+	b.state = Open
+	b.openedAt = now
+}
+
+// Must hold the lock.
+func (b *Breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+func (b *Breaker) notify(from, to State) {
+	if from != to && b.OnStateChange != nil {
+		b.OnStateChange(from, to)
+	}
+}
+
+func (b *Breaker) failureRate() float64 {
+	if b.FailureRate > 0 {
+		return b.FailureRate
+	}
+	return 0.5
+}
+
+func (b *Breaker) minRequests() int {
+	if b.MinRequests > 0 {
+		return b.MinRequests
+	}
+	return 20
+}
+
+func (b *Breaker) window() time.Duration {
+	if b.Window > 0 {
+		return b.Window
+	}
+	return 10 * time.Second
+}
+
+func (b *Breaker) openTimeout() time.Duration {
+	if b.OpenTimeout > 0 {
+		return b.OpenTimeout
+	}
+	return 5 * time.Second
+}
+
+func (b *Breaker) probes() int {
+	if b.Probes > 0 {
+		return b.Probes
+	}
+	return 1
+}
@@ -0,0 +1,81 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+type fakeRequester struct {
+	err   error
+	calls int
+}
+
+func (f *fakeRequester) MakeRequest(target string, body []byte) ([]byte, error) {
+	f.calls++
+	return nil, f.err
+}
+
+func TestBreakerLifecycle(t *testing.T) {
+	requester := &fakeRequester{err: &dynago.Error{Type: dynago.ErrorServiceUnavailable}}
+	var changes []State
+	b := &Breaker{
+		Requester:     requester,
+		MinRequests:   4,
+		OpenTimeout:   20 * time.Millisecond,
+		OnStateChange: func(from, to State) { changes = append(changes, to) },
+	}
+
+	for i := 0; i < 4; i++ {
+		b.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	}
+	if b.State() != Open {
+		t.Fatalf("Expected open, got %s", b.State())
+	}
+	_, err := b.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	if _, ok := err.(*OpenError); !ok {
+		t.Errorf("Expected *OpenError, got %v", err)
+	}
+	if requester.calls != 4 {
+		t.Errorf("Expected 4 calls, got %d", requester.calls)
+	}
+
+	// After the timeout a failing probe re-opens the breaker.
+	time.Sleep(25 * time.Millisecond)
+	b.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	if b.State() != Open {
+		t.Errorf("Expected open after failed probe, got %s", b.State())
+	}
+
+	// And a successful probe closes it.
+	time.Sleep(25 * time.Millisecond)
+	requester.err = nil
+	if _, err := b.MakeRequest("DynamoDB_20120810.GetItem", nil); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if b.State() != Closed {
+		t.Errorf("Expected closed, got %s", b.State())
+	}
+
+	expected := []State{Open, HalfOpen, Open, HalfOpen, Closed}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected changes %v, got %v", expected, changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Change %d: Expected %s, got %s", i, expected[i], changes[i])
+		}
+	}
+}
+
+func TestBreakerIgnoresClientErrors(t *testing.T) {
+	requester := &fakeRequester{err: &dynago.Error{Type: dynago.ErrorConditionFailed}}
+	b := &Breaker{Requester: requester, MinRequests: 2}
+	for i := 0; i < 10; i++ {
+		b.MakeRequest("DynamoDB_20120810.PutItem", nil)
+	}
+	if b.State() != Closed {
+		t.Errorf("Expected closed, got %s", b.State())
+	}
+}
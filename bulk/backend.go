@@ -0,0 +1,103 @@
+package bulk
+
+import (
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// The requests a BulkWriter makes, so they can be faked out in tests.
+type backend interface {
+	// Write a batch, returning the items left unprocessed.
+	batchWrite(table string, items []*item) ([]*item, error)
+	putItem(table string, doc dynago.Document) error
+	deleteItem(table string, key dynago.Document) error
+}
+
+// The backend used for real requests, through a dynago client.
+type clientBackend struct {
+	client *dynago.Client
+	keys   []string // The table's key schema, if known
+}
+
+func (c clientBackend) batchWrite(table string, items []*item) ([]*item, error) {
+	var docs, deleteKeys []dynago.Document
+	for _, it := range items {
+		if it.delete {
+			deleteKeys = append(deleteKeys, it.doc)
+		} else {
+			docs = append(docs, it.doc)
+		}
+	}
+	batch := c.client.BatchWrite()
+	if len(docs) > 0 {
+		batch = batch.Put(table, docs...)
+	}
+	if len(deleteKeys) > 0 {
+		batch = batch.Delete(table, deleteKeys...)
+	}
+	result, err := batch.Execute()
+	if err != nil {
+		return nil, err
+	}
+	var returned []*item
+	for _, entry := range result.UnprocessedItems[table] {
+		if entry.PutRequest != nil {
+			returned = append(returned, &item{doc: entry.PutRequest.Item})
+		} else {
+			returned = append(returned, &item{doc: entry.DeleteRequest.Key, delete: true})
+		}
+	}
+	return matchUnprocessed(items, returned, c.keys), nil
+}
+
+/*
+Match the unprocessed items DynamoDB returned, which are decoded afresh, to
+the items we sent. They are matched by key when the key schema is known, and
+otherwise by all their attributes, with numbers compared by value.
+
+A returned item which matches none sent is retried as it came back rather
+than failing the batch, as whatever was written still was.
+*/
+func matchUnprocessed(sent, returned []*item, schema []string) []*item {
+	if len(returned) == 0 {
+		return nil
+	}
+	byKey := make(map[string][]*item, len(sent))
+	for _, it := range sent {
+		k := matchKey(it, schema)
+		byKey[k] = append(byKey[k], it)
+	}
+	unprocessed := make([]*item, 0, len(returned))
+	for _, r := range returned {
+		k := matchKey(r, schema)
+		matches := byKey[k]
+		if len(matches) == 0 {
+			r.measure()
+			unprocessed = append(unprocessed, r)
+			continue
+		}
+		unprocessed = append(unprocessed, matches[0])
+		byKey[k] = matches[1:]
+	}
+	return unprocessed
+}
+
+func matchKey(it *item, schema []string) string {
+	key := itemKey(it.doc, schema)
+	if key == "" {
+		key = canonical(it.doc)
+	}
+	if it.delete {
+		return "delete:" + key
+	}
+	return "put:" + key
+}
+
+func (c clientBackend) putItem(table string, doc dynago.Document) error {
+	_, err := c.client.PutItem(table, doc).Execute()
+	return err
+}
+
+func (c clientBackend) deleteItem(table string, key dynago.Document) error {
+	_, err := c.client.DeleteItem(table, key).Execute()
+	return err
+}
@@ -1,9 +1,14 @@
 package bulk
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/crast/dynatools/autoretry"
+	"github.com/crast/dynatools/internal"
+	"github.com/crast/dynatools/tracing"
 	"gopkg.in/underarmour/dynago.v1"
 )
 
@@ -16,34 +21,134 @@ type Config struct {
 	// effectively sets the max parallel writes we can do on the table.
 	Concurrency int // Defaults to 1 if unset
 
+	// The range concurrency may be scaled within: cut back when DynamoDB
+	// returns unprocessed items or throttles, and raised again while
+	// batches succeed in full. Both default to Concurrency, which keeps
+	// concurrency fixed.
+	MinConcurrency int
+	MaxConcurrency int
+
 	// How many records to write per bulk write.
 	PerWrite int // Defaults to 25 if unset
+
+	// The most bytes of encoded items to send in one bulk write.
+	MaxBatchBytes int // Defaults to MaxRequestSize
+
+	// If set, a partial batch is sent once its oldest record has been
+	// waiting this long, rather than waiting for PerWrite records.
+	FlushInterval time.Duration
+
+	// Target write capacity units per second, shared between all workers.
+	// Items use one unit per KB or part of one, and deletes one unit each.
+	// Can be changed while writing with SetWriteCapacity. Unlimited if zero.
+	WriteCapacity float64
+
+	// Optional retry budget, shared between all workers and possibly with
+	// other writers or AutoRetry instances. When it is empty, failed
+	// writes are reported as errors instead of being retried.
+	RetryBudget *autoretry.Budget
+
+	// Optional tracer, recording a span for each group of writes with a
+	// child span for each request made to write it.
+	Tracer *tracing.Tracer
+
+	// The names of the table's key attributes, such as from KeySchema. If
+	// set, writes to the same key within a batch are collapsed so only the
+	// last one is sent, as DynamoDB rejects batches with duplicate keys.
+	// Unprocessed items are also matched up by key rather than by all
+	// their attributes.
+	KeySchema []string
+
+	// Optional sink for every item which fails to be written, such as a
+	// FileSink, so failures aren't lost if results are thrown away.
+	DeadLetters DeadLetterSink
+
+	// What to do with batches already being written when the context
+	// given to NewContext is cancelled.
+	OnCancel AbortPolicy // Defaults to FinishInFlight
 }
 
+// AbortPolicy decides what happens to in-flight batches on cancellation.
+type AbortPolicy int
+
+const (
+	// Finish writing the batches workers have already started, retries and
+	// all. Only items which were still queued are reported as failed.
+	FinishInFlight AbortPolicy = iota
+
+	// Stop as soon as the request in progress returns, reporting every item
+	// not yet written as failed. Retry delays are cut short.
+	AbandonInFlight
+)
+
 func (c *Config) setDefaults() {
 	if c.Concurrency < 1 {
 		c.Concurrency = 1
 	}
 
+	if c.MinConcurrency < 1 || c.MinConcurrency > c.Concurrency {
+		c.MinConcurrency = c.Concurrency
+	}
+
+	if c.MaxConcurrency < c.Concurrency {
+		c.MaxConcurrency = c.Concurrency
+	}
+
 	if c.PerWrite < 1 {
 		c.PerWrite = 25
 	}
+
+	if c.MaxBatchBytes < 1 {
+		c.MaxBatchBytes = MaxRequestSize
+	}
 }
 
-// Create a new BulkWriter.
+/*
+Create a new BulkWriter.
+
+Without a context to cancel, results must be read until CloseWait returns,
+or CloseWait blocks forever. Use NewContext to be able to give up on them.
+*/
 func New(config Config) *BulkWriter {
+	return NewContext(context.Background(), config)
+}
+
+/*
+Create a new BulkWriter which stops writing once ctx is cancelled.
+
+After cancellation Write and Delete return the context's error, nothing more
+is sent to DynamoDB except what config.OnCancel allows to finish, and every
+item left unsent is reported as failed with the context's error. From then
+on all Results, including those of batches allowed to finish, are kept for
+Undelivered rather than sent on the results channel. CloseWait must still be
+called to wait for the workers to stop.
+*/
+func NewContext(ctx context.Context, config Config) *BulkWriter {
+	return newWriter(ctx, config, clientBackend{config.Client, config.KeySchema})
+}
+
+func newWriter(ctx context.Context, config Config, backend backend) *BulkWriter {
 	config.setDefaults()
 
 	writer := &BulkWriter{
-		client:  config.Client,
+		ctx:     ctx,
+		abort:   config.OnCancel,
+		backend: backend,
 		table:   config.Table,
+		keys:    config.KeySchema,
+		budget:  config.RetryBudget,
+		dead:    config.DeadLetters,
+		tracer:  config.Tracer,
+		scale:   newScaler(config.MinConcurrency, config.MaxConcurrency, config.Concurrency),
 		ch:      make(chan message, config.Concurrency*10),
 		groups:  make(chan group),
 		results: make(chan Result),
 	}
+	writer.counters.latency = internal.NewLatencyWindow(latencyWindow)
+	writer.capacity = internal.NewTokenBucket(config.WriteCapacity, config.WriteCapacity, 0)
 	writer.wg.Add(1)
-	go writer.main(config.PerWrite)
-	for i := 0; i < config.Concurrency; i++ {
+	go writer.main(config)
+	for i := 0; i < config.MaxConcurrency; i++ {
 		writer.wg.Add(1)
 		go writer.worker(i)
 	}
@@ -54,12 +159,25 @@ func New(config Config) *BulkWriter {
 BulkWriter manages a series of bulk operations.
 */
 type BulkWriter struct {
-	client  *dynago.Client
-	table   string
-	ch      chan message
-	groups  chan group
-	results chan Result
-	wg      sync.WaitGroup
+	ctx      context.Context
+	abort    AbortPolicy
+	backend  backend
+	table    string
+	keys     []string
+	capacity *internal.TokenBucket // Write capacity units, allowing a second's burst
+	scale    *scaler
+	budget   *autoretry.Budget
+	dead     DeadLetterSink
+	tracer   *tracing.Tracer
+	ch       chan message
+	groups   chan group
+	results  chan Result
+	wg       sync.WaitGroup
+
+	counters counters
+
+	mu          sync.Mutex
+	undelivered []Result
 }
 
 /*
@@ -67,28 +185,222 @@ Queue up a write.
 This function is safe to call from any number of goroutines. It will
 block only if all workers are presently executing batches plus our buffer
 is full, creating built-in back-pressure on writing.
+
+Documents over MaxItemSize are never sent, and are reported as a failed
+Result with an *ItemTooLargeError.
+
+Once the context is cancelled Write returns its error instead. A write
+racing with the cancellation may be accepted and then reported as a failed
+Result.
+*/
+func (b *BulkWriter) Write(doc dynago.Document) error {
+	return b.queueItem(&item{doc: doc})
+}
+
+/*
+Queue up a delete, as with Write.
+*/
+func (b *BulkWriter) Delete(key dynago.Document) error {
+	return b.queueItem(&item{doc: key, delete: true})
+}
+
+/*
+Queue up a write, returning a Future for its outcome.
+
+The outcome is only reported through the Future, not on the results
+channel. If the write can't be queued because the context was cancelled, the
+Future is already resolved with the error.
+*/
+func (b *BulkWriter) WriteAsync(doc dynago.Document) *Future {
+	return b.queueAsync(&item{doc: doc, future: newFuture()})
+}
+
+// Queue up a delete, returning a Future for its outcome, as with WriteAsync.
+func (b *BulkWriter) DeleteAsync(key dynago.Document) *Future {
+	return b.queueAsync(&item{doc: key, delete: true, future: newFuture()})
+}
+
+func (b *BulkWriter) queueAsync(it *item) *Future {
+	if err := b.queueItem(it); err != nil {
+		it.future.resolve(err)
+	}
+	return it.future
+}
+
+// Queue an item, marking it failed if it's too large to ever be written.
+func (b *BulkWriter) queueItem(it *item) error {
+	it.measure()
+	if it.itemSize > MaxItemSize {
+		it.err = &ItemTooLargeError{Size: it.itemSize}
+	}
+	if err := b.queue(message{item: it}); err != nil {
+		return err
+	}
+	atomic.AddInt64(&b.counters.queued, 1)
+	return nil
+}
+
+func (b *BulkWriter) queue(msg message) error {
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case b.ch <- msg:
+		return nil
+	case <-b.ctx.Done():
+		return b.ctx.Err()
+	}
+}
+
+/*
+Flush sends any partial batch right away, and blocks until everything queued
+before the call has produced a Result or resolved its Future.
+
+Results must be read while Flush is blocked, as with any other write. Flush
+must not be called after CloseWait, and returns the context's error without
+waiting if the context was cancelled first.
 */
-func (b *BulkWriter) Write(doc dynago.Document) {
-	b.ch <- message{doc: doc}
+func (b *BulkWriter) Flush() error {
+	done := make(chan struct{})
+	if err := b.queue(message{flushed: done}); err != nil {
+		return err
+	}
+	<-done
+	return nil
 }
 
 /*
-Queue up a delete.
+SetWriteCapacity changes the target write capacity units per second, taking
+effect for the next request made. Zero removes the limit.
 */
-func (b *BulkWriter) Delete(key dynago.Document) {
-	b.ch <- message{deleteKey: key}
+func (b *BulkWriter) SetWriteCapacity(units float64) {
+	b.capacity.SetRate(units, units)
+}
+
+// WriteCapacity returns the target write capacity units per second, or zero if unlimited.
+func (b *BulkWriter) WriteCapacity() float64 {
+	return b.capacity.Rate()
+}
+
+// Concurrency returns how many workers are currently allowed to write at once.
+func (b *BulkWriter) Concurrency() int {
+	return b.scale.current()
 }
 
 /*
 Get the results channel.
 
 You must listen on the results channel (even if only to throw them away)
-or otherwise all the workers will deadlock.
+or otherwise all the workers will deadlock. Items queued with WriteAsync or
+DeleteAsync never appear here.
 */
 func (b *BulkWriter) Results() <-chan Result {
 	return b.results
 }
 
+/*
+Undelivered returns the Results produced after the context was cancelled.
+Once it is cancelled, results are never sent on the results channel, so
+nothing blocks on a reader which has gone away. It is only complete once
+CloseWait has returned.
+*/
+func (b *BulkWriter) Undelivered() []Result {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Result(nil), b.undelivered...)
+}
+
+// Send a result, or keep it for Undelivered once the context is cancelled.
+func (b *BulkWriter) deliver(r Result) {
+	if b.ctx.Err() == nil {
+		select {
+		case b.results <- r:
+			return
+		case <-b.ctx.Done():
+		}
+	}
+	b.mu.Lock()
+	b.undelivered = append(b.undelivered, r)
+	b.mu.Unlock()
+}
+
+/*
+Report the outcome of items: resolving the futures of async items, and
+sending one Result for all the rest.
+*/
+func (b *BulkWriter) report(items []*item, err error) {
+	var result Result
+	for _, it := range items {
+		b.count(it, err)
+		if it.future != nil {
+			it.future.resolve(err)
+		} else if it.delete {
+			result.DeleteKeys = append(result.DeleteKeys, it.doc)
+		} else {
+			result.Documents = append(result.Documents, it.doc)
+		}
+	}
+	if len(result.Documents) > 0 || len(result.DeleteKeys) > 0 {
+		if err != nil {
+			result.Error = err
+			result.DynagoError = internal.AssertError(err)
+		}
+		b.deliver(result)
+	}
+}
+
+// Count an item's outcome in the stats.
+func (b *BulkWriter) count(it *item, err error) {
+	c := &b.counters
+	switch {
+	case err != nil && b.isAbandoned(err):
+		atomic.AddInt64(&c.abandoned, 1)
+	case err != nil:
+		atomic.AddInt64(&c.failed, 1)
+		b.deadLetter(it, err)
+	case it.delete:
+		atomic.AddInt64(&c.deleted, 1)
+	default:
+		atomic.AddInt64(&c.written, 1)
+		atomic.AddInt64(&c.bytes, int64(it.itemSize))
+	}
+}
+
+// Whether err is the context's, so the item was given up on rather than failing.
+func (b *BulkWriter) isAbandoned(err error) bool {
+	return b.ctx.Err() != nil && err == b.ctx.Err()
+}
+
+func (b *BulkWriter) deadLetter(it *item, err error) {
+	if b.dead == nil {
+		return
+	}
+	letter := DeadLetter{
+		Op:        OpPut,
+		Item:      it.doc,
+		ErrorType: internal.ErrorType(err),
+		Message:   err.Error(),
+		Attempts:  it.attempts,
+		Time:      time.Now(),
+	}
+	if it.delete {
+		letter.Op = OpDelete
+	}
+	b.dead.DeadLetter(letter)
+}
+
+// Report an item replaced by a later write to the same key.
+func (b *BulkWriter) supersede(it *item) {
+	atomic.AddInt64(&b.counters.superseded, 1)
+	if it.future != nil {
+		it.future.supersede()
+	} else if it.delete {
+		b.deliver(Result{DeleteKeys: []dynago.Document{it.doc}, Superseded: true})
+	} else {
+		b.deliver(Result{Documents: []dynago.Document{it.doc}, Superseded: true})
+	}
+}
+
 /*
 Close this BulkWriter, and wait until all our existing operations have
 completed. You must not call Write anymore after CloseWait has been called.
@@ -101,139 +413,377 @@ func (b *BulkWriter) CloseWait() {
 	close(b.results)
 }
 
-func (b *BulkWriter) main(perWrite int) {
+func (b *BulkWriter) main(config Config) {
 	defer func() {
 		b.wg.Done()
 	}()
-	var running = true
-	for running {
-		g := group{}
-
-		for i := 0; i < perWrite; i++ {
-			var msg message
-			msg, running = <-b.ch
-			if running {
-				if msg.doc != nil {
-					g.docs = append(g.docs, msg.doc)
-				} else {
-					g.deleteKeys = append(g.deleteKeys, msg.deleteKey)
-				}
-			} else {
-				break
+	var g group
+	var timer *time.Timer
+	var oldest <-chan time.Time // Fires when the first message in g is too old
+	// Groups handed to workers which may not be done yet.
+	var outstanding []chan struct{}
+
+	send := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, oldest = nil, nil
+		}
+		if g.length() == 0 {
+			return
+		}
+		g.done = make(chan struct{})
+		select {
+		case b.groups <- g:
+			outstanding = append(pending(outstanding), g.done)
+		case <-b.ctx.Done():
+			b.report(g.items, b.ctx.Err())
+		}
+		g = group{}
+	}
+
+	for {
+		select {
+		case msg, ok := <-b.ch:
+			if !ok {
+				send()
+				close(b.groups)
+				return
 			}
+			if msg.flushed != nil {
+				send()
+				go waitAll(append([]chan struct{}(nil), outstanding...), msg.flushed)
+				continue
+			}
+			if msg.item.err != nil {
+				b.report([]*item{msg.item}, msg.item.err)
+				continue
+			}
+			if g.length() > 0 && g.bytes+msg.item.size > config.MaxBatchBytes {
+				send()
+			}
+			if superseded := g.add(msg.item, b.keys); superseded != nil {
+				b.supersede(superseded)
+			}
+			if g.length() >= config.PerWrite {
+				send()
+			} else if g.length() == 1 && config.FlushInterval > 0 {
+				timer = time.NewTimer(config.FlushInterval)
+				oldest = timer.C
+			}
+		case <-oldest:
+			send()
+		case <-b.ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			b.drain(g, outstanding)
+			return
 		}
-		if g.length() > 0 {
-			b.groups <- g
+	}
+}
+
+// After cancellation, fail everything still queued until CloseWait.
+func (b *BulkWriter) drain(g group, outstanding []chan struct{}) {
+	err := b.ctx.Err()
+	b.report(g.items, err)
+	for msg := range b.ch {
+		if msg.flushed != nil {
+			go waitAll(outstanding, msg.flushed)
+		} else if msg.item.err != nil {
+			b.report([]*item{msg.item}, msg.item.err)
+		} else {
+			b.report([]*item{msg.item}, err)
 		}
 	}
 	close(b.groups)
 }
 
+// Filter out the channels which are already closed.
+func pending(chans []chan struct{}) []chan struct{} {
+	kept := chans[:0]
+	for _, ch := range chans {
+		select {
+		case <-ch:
+		default:
+			kept = append(kept, ch)
+		}
+	}
+	return kept
+}
+
+// Wait for all of chans to close, then close done.
+func waitAll(chans []chan struct{}, done chan struct{}) {
+	for _, ch := range chans {
+		<-ch
+	}
+	close(done)
+}
+
 func (b *BulkWriter) worker(id int) {
 	defer func() {
 		b.wg.Done()
 	}()
 	for group := range b.groups {
-		origGroup := group
-		waitFor := 100 * time.Millisecond
-		for i := 0; i < 5; i++ {
-			group = b.runBatch(group, &waitFor)
-			if group.length() < origGroup.length() {
-				break
+		if err := b.ctx.Err(); err != nil {
+			// Handed over just as the context was cancelled, so never started.
+			b.report(group.items, err)
+		} else {
+			b.scale.acquire()
+			if err := b.ctx.Err(); err != nil {
+				// Cancelled while waiting for a turn, so never started either.
+				b.report(group.items, err)
+			} else {
+				b.writeGroup(group)
 			}
+			b.scale.release()
 		}
+		close(group.done)
+	}
+}
 
-		// Run any remaining documents individually
-		for _, doc := range group.docs {
-			rlist := []dynago.Document{doc}
-			for {
-				_, err := b.client.PutItem(b.table, doc).Execute()
-				if err == nil {
-					b.results <- Result{Documents: rlist}
-					break
-				} else if !b.retryLogic(err, &waitFor, rlist, nil) {
-					break
-				}
-			}
+func (b *BulkWriter) writeGroup(g group) {
+	ctx, span := b.tracer.Start(b.ctx, "bulk.write")
+	span.SetAttr(tracing.AttrTable, b.table)
+	span.SetAttr("bulk.items", g.length())
+	var failed error
+	defer func() {
+		if failed != nil {
+			span.SetAttr(tracing.AttrErrorType, internal.ErrorType(failed))
 		}
-		// run any remaining deletes individually
-		for _, key := range group.deleteKeys {
-			dList := []dynago.Document{key}
-			_, err := b.client.DeleteItem(b.table, key).Execute()
+		span.End(failed)
+	}()
+
+	items := g.items
+	waitFor := 100 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		if b.abandoned(items, &failed) {
+			return
+		}
+		remaining := b.runBatch(ctx, i+1, items, &waitFor, &failed)
+		progressed := len(remaining) < len(items)
+		items = remaining
+		if progressed {
+			break
+		}
+	}
+
+	// Run any remaining items individually
+	for i, it := range items {
+		for attempt := 1; ; attempt++ {
+			if b.abandoned(items[i:], &failed) {
+				return
+			}
+			if b.capacity.Wait(b.waitContext(), it.units) != nil {
+				continue // Abandoned while waiting
+			}
+			atomic.AddInt64(&b.counters.individual, 1)
+			it.attempts++
+			var err error
+			if it.delete {
+				err = b.trace(ctx, "DeleteItem", attempt, func() error {
+					return b.backend.deleteItem(b.table, it.doc)
+				})
+			} else {
+				err = b.trace(ctx, "PutItem", attempt, func() error {
+					return b.backend.putItem(b.table, it.doc)
+				})
+			}
 			if err == nil {
-				b.results <- Result{DeleteKeys: dList}
+				b.budget.Deposit()
+				b.report([]*item{it}, nil)
 				break
-			} else if !b.retryLogic(err, &waitFor, nil, dList) {
+			} else if !b.retryLogic(err, &waitFor, []*item{it}) {
+				failed = err
 				break
 			}
 		}
 	}
 }
 
-func (b *BulkWriter) runBatch(g group, waitFor *time.Duration) group {
-	batch := b.client.BatchWrite()
-	if len(g.docs) > 0 {
-		batch = batch.Put(b.table, g.docs...)
+/*
+If in-flight writes are being abandoned, report the remaining items as
+failed and return true.
+*/
+func (b *BulkWriter) abandoned(items []*item, failed *error) bool {
+	if b.abort != AbandonInFlight || b.ctx.Err() == nil {
+		return false
+	}
+	if len(items) > 0 {
+		*failed = b.ctx.Err()
+		b.report(items, *failed)
+	}
+	return true
+}
+
+/*
+Write items in one batch, reporting those which were processed, and return
+the unprocessed ones which still need writing.
+*/
+func (b *BulkWriter) runBatch(ctx context.Context, attempt int, items []*item, waitFor *time.Duration, failed *error) []*item {
+	var units float64
+	for _, it := range items {
+		units += it.units
+	}
+	if b.capacity.Wait(b.waitContext(), units) != nil {
+		return items // Abandoned while waiting
 	}
-	if len(g.deleteKeys) > 0 {
-		batch = batch.Delete(b.table, g.deleteKeys...)
+	for _, it := range items {
+		it.attempts++
 	}
-	result, err := batch.Execute()
+	var unprocessed []*item
+	err := b.trace(ctx, "BatchWriteItem", attempt, func() (err error) {
+		start := time.Now()
+		unprocessed, err = b.backend.batchWrite(b.table, items)
+		b.counters.latency.Add(time.Since(start))
+		return
+	})
+	atomic.AddInt64(&b.counters.batches, 1)
 	if err == nil {
-		b.results <- Result{Documents: g.docs, DeleteKeys: g.deleteKeys}
-		g = group{}
-		for _, item := range result.UnprocessedItems[b.table] {
-			if item.PutRequest != nil {
-				g.docs = append(g.docs, item.PutRequest.Item)
-			} else {
-				g.deleteKeys = append(g.deleteKeys, item.DeleteRequest.Key)
-			}
+		b.budget.Deposit()
+		atomic.AddInt64(&b.counters.unprocessed, int64(len(unprocessed)))
+		if len(unprocessed) > 0 {
+			b.scale.pushedBack()
+		} else {
+			b.scale.succeeded()
 		}
-	} else if !b.retryLogic(err, waitFor, g.docs, g.deleteKeys) {
-		return group{}
+		b.report(processed(items, unprocessed), nil)
+		return unprocessed
+	}
+	if internal.IsThrottle(err) {
+		b.scale.pushedBack()
+	}
+	if !b.retryLogic(err, waitFor, items) {
+		*failed = err
+		return nil
+	}
+	return items
+}
+
+// The items which are not in unprocessed.
+func processed(items, unprocessed []*item) []*item {
+	if len(unprocessed) == 0 {
+		return items
+	}
+	left := make(map[*item]bool, len(unprocessed))
+	for _, it := range unprocessed {
+		left[it] = true
+	}
+	var done []*item
+	for _, it := range items {
+		if !left[it] {
+			done = append(done, it)
+		}
+	}
+	return done
+}
+
+// Run a single request in a child span of ctx.
+func (b *BulkWriter) trace(ctx context.Context, name string, attempt int, request func() error) error {
+	_, span := b.tracer.Start(ctx, name)
+	span.SetAttr(tracing.AttrTable, b.table)
+	span.SetAttr(tracing.AttrAttempt, attempt)
+	err := request()
+	if err != nil {
+		span.SetAttr(tracing.AttrErrorType, internal.ErrorType(err))
 	}
-	return g
+	span.End(err)
+	return err
 }
 
-func (b *BulkWriter) retryLogic(err error, waitFor *time.Duration, toWrite []dynago.Document, toDelete []dynago.Document) bool {
-	if e, ok := err.(*dynago.Error); ok {
-		if canRetry(e) {
-			time.Sleep(*waitFor)
+func (b *BulkWriter) retryLogic(err error, waitFor *time.Duration, items []*item) bool {
+	if internal.IsThrottle(err) {
+		atomic.AddInt64(&b.counters.throttles, 1)
+	}
+	if canRetry(err) && b.budget.Withdraw() {
+		if b.sleep(*waitFor) {
 			*waitFor *= 2
 			return true
-		} else {
-			b.results <- Result{Documents: toWrite, DeleteKeys: toDelete, Error: err, DynagoError: e}
-			return false
 		}
-	} else {
-		b.results <- Result{Documents: toWrite, DeleteKeys: toDelete, Error: err}
-		return false
+		err = b.ctx.Err()
+	}
+	b.report(items, err)
+	return false
+}
+
+// The context for waits which are cut short by abandoning in-flight writes.
+func (b *BulkWriter) waitContext() context.Context {
+	if b.abort == AbandonInFlight {
+		return b.ctx
 	}
+	return context.Background()
 }
 
-func canRetry(e *dynago.Error) bool {
-	switch e.Type {
-	case dynago.ErrorThrottling, dynago.ErrorThroughputExceeded:
+// Sleep before a retry, returning false if cut short by abandoning in-flight writes.
+func (b *BulkWriter) sleep(d time.Duration) bool {
+	if b.abort != AbandonInFlight {
+		time.Sleep(d)
 		return true
-	case dynago.ErrorServiceUnavailable, dynago.ErrorInternalFailure:
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
 		return true
-	default:
+	case <-b.ctx.Done():
 		return false
 	}
 }
 
+func canRetry(err error) bool {
+	return internal.IsRetryable(err)
+}
+
 type group struct {
-	docs       []dynago.Document
-	deleteKeys []dynago.Document
+	items []*item
+	bytes int            // Total request size of items
+	keys  map[string]int // Index in items by key, when the key schema is known
+	done  chan struct{}  // Closed once every item has been reported
 }
 
 func (g group) length() int {
-	return len(g.docs) + len(g.deleteKeys)
+	return len(g.items)
+}
+
+/*
+Add an item, replacing any item with the same key in its place. The
+replaced item is returned.
+*/
+func (g *group) add(it *item, schema []string) (superseded *item) {
+	if len(schema) > 0 {
+		if key := itemKey(it.doc, schema); key != "" {
+			if i, ok := g.keys[key]; ok {
+				superseded, g.items[i] = g.items[i], it
+				g.bytes += it.size - superseded.size
+				return superseded
+			}
+			if g.keys == nil {
+				g.keys = make(map[string]int)
+			}
+			g.keys[key] = len(g.items)
+		}
+	}
+	g.items = append(g.items, it)
+	g.bytes += it.size
+	return nil
+}
+
+// A single queued put or delete.
+type item struct {
+	doc      dynago.Document // The document to put, or the key to delete
+	delete   bool
+	size     int     // Bytes the item takes up in a batch request
+	itemSize int     // The document's size, as worked out by ItemSize
+	units    float64 // Write capacity units the item uses
+	// Requests made which included the item. Only touched by the worker
+	// writing it.
+	attempts int
+	future   *Future // Set for items queued with WriteAsync or DeleteAsync
+	err      error   // Set for items rejected without being sent
 }
 
 type message struct {
-	doc       dynago.Document
-	deleteKey dynago.Document
+	item    *item
+	flushed chan struct{} // Set for a Flush marker
 }
 
 type Result struct {
@@ -241,4 +791,8 @@ type Result struct {
 	DeleteKeys  []dynago.Document // Deleted keys
 	Error       error             // If there's an error, then this is set
 	DynagoError *dynago.Error     // If the error happens to be a dynago.Error, then we set this too.
+
+	// Set when the item was replaced by a later write to the same key in
+	// the same batch, so was never sent itself.
+	Superseded bool
 }
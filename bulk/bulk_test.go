@@ -0,0 +1,531 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crast/dynatools/tracing"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// A backend which records every request, failing as told.
+type fakeBackend struct {
+	mu      sync.Mutex
+	batches [][]*item
+	puts    []dynago.Document
+	deletes []dynago.Document
+
+	// If set, decides what part of each batch is left unprocessed.
+	unprocessed func(items []*item) []*item
+	// If set, the error for each batch, numbered from 1.
+	batchErr func(n int) error
+	// If set, each batch waits to receive from it before returning.
+	gate chan struct{}
+}
+
+func (f *fakeBackend) batchWrite(table string, items []*item) ([]*item, error) {
+	f.mu.Lock()
+	f.batches = append(f.batches, items)
+	n := len(f.batches)
+	f.mu.Unlock()
+	if f.gate != nil {
+		<-f.gate
+	}
+	if f.batchErr != nil {
+		if err := f.batchErr(n); err != nil {
+			return nil, err
+		}
+	}
+	if f.unprocessed != nil {
+		return f.unprocessed(items), nil
+	}
+	return nil, nil
+}
+
+func (f *fakeBackend) putItem(table string, doc dynago.Document) error {
+	f.mu.Lock()
+	f.puts = append(f.puts, doc)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeBackend) deleteItem(table string, key dynago.Document) error {
+	f.mu.Lock()
+	f.deletes = append(f.deletes, key)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeBackend) batchCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.batches)
+}
+
+// Make a BulkWriter using a fake backend.
+func newTestWriter(config Config, backend backend) *BulkWriter {
+	return newTestWriterContext(context.Background(), config, backend)
+}
+
+func newTestWriterContext(ctx context.Context, config Config, backend backend) *BulkWriter {
+	config.Table = "people"
+	return newWriter(ctx, config, backend)
+}
+
+// Wait up to a second for cond to be true.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Read results into a slice until the channel closes. The returned
+// function waits for that, so must only be called after CloseWait.
+func collect(writer *BulkWriter) (results func() []Result) {
+	var collected []Result
+	done := make(chan struct{})
+	go func() {
+		for r := range writer.Results() {
+			collected = append(collected, r)
+		}
+		close(done)
+	}()
+	return func() []Result {
+		<-done
+		return collected
+	}
+}
+
+func count(results []Result) (docs, deletes int) {
+	for _, r := range results {
+		docs += len(r.Documents)
+		deletes += len(r.DeleteKeys)
+	}
+	return
+}
+
+func TestFlushInterval(t *testing.T) {
+	backend := &fakeBackend{}
+	writer := newTestWriter(Config{FlushInterval: 10 * time.Millisecond}, backend)
+	results := collect(writer)
+	for i := 0; i < 3; i++ {
+		writer.Write(dynago.Document{"Id": i})
+	}
+	waitFor(t, func() bool { return backend.batchCount() > 0 })
+	if n := backend.batchCount(); n != 1 {
+		t.Fatalf("Expected the partial batch to be sent, got %d batches", n)
+	}
+	writer.CloseWait()
+	if docs, _ := count(results()); docs != 3 {
+		t.Errorf("Expected 3 documents written, got %d", docs)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	backend := &fakeBackend{}
+	writer := newTestWriter(Config{Concurrency: 2, PerWrite: 4}, backend)
+	for i := 0; i < 10; i++ {
+		writer.Write(dynago.Document{"Id": i})
+	}
+	writer.Delete(dynago.Document{"Id": 0})
+
+	// Read results here, so everything received is counted by the time Flush returns.
+	flushed := make(chan struct{})
+	go func() {
+		writer.Flush()
+		close(flushed)
+	}()
+	var results []Result
+	for waiting := true; waiting; {
+		select {
+		case r := <-writer.Results():
+			results = append(results, r)
+		case <-flushed:
+			waiting = false
+		}
+	}
+	collect(writer)
+	if docs, deletes := count(results); docs != 10 || deletes != 1 {
+		t.Errorf("Expected 10 writes and 1 delete after Flush, got %d and %d", docs, deletes)
+	}
+	if n := backend.batchCount(); n != 3 {
+		t.Errorf("Expected 3 batches, got %d", n)
+	}
+	// An empty flush doesn't block.
+	writer.Flush()
+	writer.CloseWait()
+}
+
+// Every key left unprocessed is deleted individually, not just the first.
+func TestIndividualDeletes(t *testing.T) {
+	backend := &fakeBackend{unprocessed: func(items []*item) []*item { return items }}
+	writer := newTestWriter(Config{}, backend)
+	results := collect(writer)
+	for i := 0; i < 3; i++ {
+		writer.Delete(dynago.Document{"Id": i})
+	}
+	writer.CloseWait()
+	if len(backend.deletes) != 3 {
+		t.Errorf("Expected 3 individual deletes, got %d", len(backend.deletes))
+	}
+	for _, r := range results() {
+		if r.Error != nil {
+			t.Errorf("Unexpected error %v", r.Error)
+		}
+	}
+	if _, deletes := count(results()); deletes != 3 {
+		t.Errorf("Expected 3 deletes reported, got %d", deletes)
+	}
+}
+
+func TestCancelFailsQueued(t *testing.T) {
+	backend := &fakeBackend{gate: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := newTestWriterContext(ctx, Config{PerWrite: 1}, backend)
+	writer.Write(dynago.Document{"Id": 1})
+	waitFor(t, func() bool { return backend.batchCount() == 1 })
+	writer.Write(dynago.Document{"Id": 2})
+	writer.Write(dynago.Document{"Id": 3})
+	cancel()
+	if err := writer.Write(dynago.Document{"Id": 4}); err != context.Canceled {
+		t.Errorf("Expected Write to fail after cancel, got %v", err)
+	}
+	close(backend.gate)
+	writer.CloseWait()
+
+	var written, failed int
+	for _, r := range writer.Undelivered() {
+		if r.Error == nil {
+			written += len(r.Documents)
+		} else if errors.Is(r.Error, context.Canceled) {
+			failed += len(r.Documents)
+		} else {
+			t.Errorf("Unexpected error %v", r.Error)
+		}
+	}
+	if written != 1 || failed != 2 {
+		t.Errorf("Expected 1 written and 2 failed, got %d and %d", written, failed)
+	}
+	if n := backend.batchCount(); n != 1 {
+		t.Errorf("Expected nothing sent after cancel, got %d batches", n)
+	}
+}
+
+// A group waiting for a turn to write when cancelled is failed, not written.
+func TestCancelWhileWaitingForTurn(t *testing.T) {
+	backend := &fakeBackend{gate: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := newTestWriterContext(ctx, Config{PerWrite: 1, Concurrency: 1, MaxConcurrency: 2}, backend)
+	writer.Write(dynago.Document{"Id": 1})
+	waitFor(t, func() bool { return backend.batchCount() == 1 })
+	// Once the third item is taken off the queue, the second has been handed
+	// to the idle worker, which is waiting for the first to finish.
+	writer.Write(dynago.Document{"Id": 2})
+	writer.Write(dynago.Document{"Id": 3})
+	waitFor(t, func() bool { return len(writer.ch) == 0 })
+	cancel()
+	close(backend.gate)
+	writer.CloseWait()
+
+	failed := map[interface{}]bool{}
+	for _, r := range writer.Undelivered() {
+		for _, doc := range r.Documents {
+			failed[doc["Id"]] = r.Error != nil
+		}
+	}
+	if failed[1] || !failed[2] || !failed[3] {
+		t.Errorf("Expected only the first item written, got %v", failed)
+	}
+	if n := backend.batchCount(); n != 1 {
+		t.Errorf("Expected nothing sent after cancel, got %d batches", n)
+	}
+}
+
+// Once cancelled, results all go to Undelivered even while someone is reading.
+func TestCancelledResultsUndelivered(t *testing.T) {
+	backend := &fakeBackend{gate: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := newTestWriterContext(ctx, Config{PerWrite: 1}, backend)
+	results := collect(writer)
+	writer.Write(dynago.Document{"Id": 1})
+	waitFor(t, func() bool { return backend.batchCount() == 1 })
+	cancel()
+	close(backend.gate)
+	writer.CloseWait()
+	if r := results(); len(r) != 0 {
+		t.Errorf("Expected nothing on the results channel after cancel, got %v", r)
+	}
+	if r := writer.Undelivered(); len(r) != 1 || r[0].Error != nil || len(r[0].Documents) != 1 {
+		t.Errorf("Expected the finished batch in Undelivered, got %v", r)
+	}
+}
+
+func TestAbandonInFlight(t *testing.T) {
+	backend := &fakeBackend{batchErr: func(int) error {
+		return &dynago.Error{Type: dynago.ErrorThroughputExceeded}
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := newTestWriterContext(ctx, Config{PerWrite: 2, OnCancel: AbandonInFlight}, backend)
+	writer.Write(dynago.Document{"Id": 1})
+	writer.Write(dynago.Document{"Id": 2})
+	waitFor(t, func() bool { return backend.batchCount() == 1 })
+	start := time.Now()
+	cancel()
+	writer.CloseWait()
+	if time.Since(start) > 50*time.Millisecond {
+		t.Errorf("Expected the retry delay to be cut short")
+	}
+	results := writer.Undelivered()
+	if len(results) != 1 || len(results[0].Documents) != 2 || !errors.Is(results[0].Error, context.Canceled) {
+		t.Errorf("Unexpected results %+v", results)
+	}
+}
+
+// Leaves every other item unprocessed on the first batch only.
+func unprocessedOnce() func(items []*item) []*item {
+	first := true
+	return func(items []*item) []*item {
+		if !first {
+			return nil
+		}
+		first = false
+		var left []*item
+		for i := 1; i < len(items); i += 2 {
+			left = append(left, items[i])
+		}
+		return left
+	}
+}
+
+func TestUnprocessedReportedOnce(t *testing.T) {
+	backend := &fakeBackend{unprocessed: unprocessedOnce()}
+	writer := newTestWriter(Config{PerWrite: 4}, backend)
+	results := collect(writer)
+	for i := 0; i < 4; i++ {
+		writer.Write(dynago.Document{"Id": i})
+	}
+	writer.CloseWait()
+	seen := map[interface{}]int{}
+	for _, r := range results() {
+		if r.Error != nil {
+			t.Errorf("Unexpected error %v", r.Error)
+		}
+		for _, doc := range r.Documents {
+			seen[doc["Id"]]++
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if seen[i] != 1 {
+			t.Errorf("Expected document %d reported once, got %d", i, seen[i])
+		}
+	}
+}
+
+func TestWriteAsync(t *testing.T) {
+	backend := &fakeBackend{unprocessed: unprocessedOnce()}
+	writer := newTestWriter(Config{PerWrite: 4}, backend)
+	results := collect(writer)
+	var futures []*Future
+	for i := 0; i < 3; i++ {
+		futures = append(futures, writer.WriteAsync(dynago.Document{"Id": i}))
+	}
+	futures = append(futures, writer.DeleteAsync(dynago.Document{"Id": 9}))
+	for i, f := range futures {
+		if err := f.Wait(); err != nil {
+			t.Errorf("Future %d failed: %v", i, err)
+		}
+	}
+	writer.CloseWait()
+	if r := results(); len(r) != 0 {
+		t.Errorf("Expected no results on the channel, got %v", r)
+	}
+	if len(backend.puts) != 1 || len(backend.deletes) != 1 {
+		t.Errorf("Expected the unprocessed put and delete to be written individually")
+	}
+}
+
+func TestWriteAsyncFailure(t *testing.T) {
+	condition := &dynago.Error{Type: dynago.ErrorConditionFailed}
+	backend := &fakeBackend{batchErr: func(int) error { return condition }}
+	writer := newTestWriter(Config{}, backend)
+	collect(writer)
+	f := writer.WriteAsync(dynago.Document{"Id": 1})
+	if f.Err() != nil {
+		t.Errorf("Expected no error before resolving")
+	}
+	writer.Flush()
+	select {
+	case <-f.Done():
+	default:
+		t.Fatal("Expected the future to be resolved after Flush")
+	}
+	if f.Err() != condition || f.Wait() != condition {
+		t.Errorf("Expected the condition error, got %v", f.Err())
+	}
+	writer.CloseWait()
+}
+
+func TestWriteAsyncCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := newTestWriterContext(ctx, Config{}, &fakeBackend{})
+	cancel()
+	if err := writer.WriteAsync(dynago.Document{"Id": 1}).Wait(); err != context.Canceled {
+		t.Errorf("Expected a cancelled future, got %v", err)
+	}
+	writer.CloseWait()
+}
+
+func TestDeduplicateKeys(t *testing.T) {
+	backend := &fakeBackend{}
+	writer := newTestWriter(Config{PerWrite: 10, KeySchema: []string{"Id"}}, backend)
+	results := collect(writer)
+	writer.Write(dynago.Document{"Id": 1, "Name": "first"})
+	writer.Write(dynago.Document{"Id": 2, "Name": "other"})
+	f := writer.WriteAsync(dynago.Document{"Id": 1, "Name": "second"})
+	writer.Write(dynago.Document{"Id": 1, "Name": "third"})
+	writer.Delete(dynago.Document{"Id": 2})
+	writer.Write(dynago.Document{"Name": "no key"})
+	writer.CloseWait()
+
+	if len(backend.batches) != 1 {
+		t.Fatalf("Expected 1 batch, got %d", len(backend.batches))
+	}
+	batch := backend.batches[0]
+	if len(batch) != 3 || batch[0].doc["Name"] != "third" || !batch[1].delete || batch[2].doc["Name"] != "no key" {
+		t.Errorf("Unexpected batch %v", batch)
+	}
+	if !f.Superseded() || f.Err() != nil {
+		t.Errorf("Expected the async write to be superseded")
+	}
+	var superseded []string
+	for _, r := range results() {
+		if r.Superseded {
+			for _, doc := range append(r.Documents, r.DeleteKeys...) {
+				superseded = append(superseded, doc["Name"].(string))
+			}
+		}
+	}
+	if len(superseded) != 2 || superseded[0] != "first" || superseded[1] != "other" {
+		t.Errorf("Unexpected superseded items %v", superseded)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := &tracing.MemoryExporter{}
+	writer := newTestWriter(Config{Tracer: &tracing.Tracer{Exporter: exporter}}, &fakeBackend{})
+	collect(writer)
+	writer.Write(dynago.Document{"Id": 1})
+	writer.CloseWait()
+	roots := exporter.Roots()
+	if len(roots) != 1 || roots[0].Name != "bulk.write" {
+		t.Fatalf("Unexpected root spans %v", roots)
+	}
+	children := exporter.Children(roots[0])
+	if len(children) != 1 || children[0].Name != "BatchWriteItem" || children[0].Attr(tracing.AttrAttempt) != 1 {
+		t.Errorf("Expected a single BatchWriteItem attempt, got %v", children)
+	}
+}
+
+func TestMatchUnprocessed(t *testing.T) {
+	sent := []*item{
+		{doc: dynago.Document{"Id": 1, "Score": 1.5, "Tags": dynago.StringSet{"a", "b"}}},
+		{doc: dynago.Document{"Id": 2, "Score": 2}},
+		{doc: dynago.Document{"Id": 3}, delete: true},
+	}
+	// As decoded from DynamoDB's response, numbers come back as dynago.Number.
+	returned := []*item{
+		{doc: dynago.Document{"Id": dynago.Number("3")}, delete: true},
+		{doc: dynago.Document{"Id": dynago.Number("1"), "Score": dynago.Number("1.50"), "Tags": dynago.StringSet{"b", "a"}}},
+	}
+	for _, schema := range [][]string{nil, {"Id"}} {
+		unprocessed := matchUnprocessed(sent, returned, schema)
+		if len(unprocessed) != 2 || unprocessed[0] != sent[2] || unprocessed[1] != sent[0] {
+			t.Errorf("Schema %v: unexpected match %v", schema, unprocessed)
+		}
+	}
+}
+
+// Attributes dropped on the way to DynamoDB don't stop items matching.
+func TestMatchUnprocessedDropped(t *testing.T) {
+	sent := []*item{
+		{doc: dynago.Document{"Id": 1, "Note": "", "Extra": nil, "Tags": []string{"a", "b"}}},
+		{doc: dynago.Document{"Id": 2}},
+	}
+	returned := []*item{
+		{doc: dynago.Document{"Id": dynago.Number("1"), "Tags": dynago.StringSet{"b", "a"}}},
+	}
+	if unprocessed := matchUnprocessed(sent, returned, nil); len(unprocessed) != 1 || unprocessed[0] != sent[0] {
+		t.Errorf("Unexpected match %v", unprocessed)
+	}
+}
+
+// An unprocessed item matching nothing sent is retried as returned, and
+// nothing which was written is reported as failed.
+func TestUnmatchedRetried(t *testing.T) {
+	stranger := &item{doc: dynago.Document{"Id": dynago.Number("9")}}
+	first := true
+	backend := &fakeBackend{unprocessed: func(items []*item) []*item {
+		if !first {
+			return nil
+		}
+		first = false
+		return matchUnprocessed(items, []*item{stranger}, []string{"Id"})
+	}}
+	writer := newTestWriter(Config{PerWrite: 2}, backend)
+	results := collect(writer)
+	writer.Write(dynago.Document{"Id": 1})
+	writer.Write(dynago.Document{"Id": 2})
+	writer.CloseWait()
+	docs := 0
+	for _, r := range results() {
+		if r.Error != nil {
+			t.Errorf("Unexpected error %v", r.Error)
+		}
+		docs += len(r.Documents)
+	}
+	if docs != 3 {
+		t.Errorf("Expected both documents and the retried one reported, got %d", docs)
+	}
+	if len(backend.puts) != 1 || backend.puts[0]["Id"] != dynago.Number("9") {
+		t.Errorf("Expected the unmatched item retried, got %v", backend.puts)
+	}
+	if stranger.units != 1 || stranger.size == 0 {
+		t.Errorf("Expected the retried item measured, got %+v", stranger)
+	}
+}
+
+func TestWriteCapacity(t *testing.T) {
+	backend := &fakeBackend{}
+	writer := newTestWriter(Config{PerWrite: 10, WriteCapacity: 10000}, backend)
+	collect(writer)
+	// With the clock stopped, every unit used is still owed at the end.
+	now := time.Now()
+	writer.capacity.Now = func() time.Time { return now }
+	for i := 0; i < 30; i++ {
+		// Each document is 2 units, so each batch is 20.
+		writer.Write(dynago.Document{"Id": i, "Body": strings.Repeat("x", 1500)})
+	}
+	writer.Flush()
+	if wait := writer.capacity.Reserve(0); wait != 6*time.Millisecond {
+		t.Errorf("Expected 60 units at 10000/s to be owed, waiting %v", wait)
+	}
+
+	writer.SetWriteCapacity(0)
+	if writer.WriteCapacity() != 0 {
+		t.Errorf("Expected the limit to be removed")
+	}
+	writer.Write(dynago.Document{"Id": 0})
+	writer.Flush()
+	if wait := writer.capacity.Reserve(0); wait != 0 {
+		t.Errorf("Expected nothing owed without a limit, waiting %v", wait)
+	}
+	writer.CloseWait()
+}
@@ -0,0 +1,113 @@
+package bulk
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// The operations recorded in a DeadLetter.
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// DeadLetter records an item which could not be written.
+type DeadLetter struct {
+	Op        string          `json:"op"`        // OpPut or OpDelete
+	Item      dynago.Document `json:"item"`      // The document, or the key for deletes, as dynago encodes it
+	ErrorType string          `json:"errorType"` // Amazon's name for the error, or its Go type
+	Message   string          `json:"message"`
+	Attempts  int             `json:"attempts"` // Requests made which included the item
+	Time      time.Time       `json:"time"`
+}
+
+/*
+DeadLetterSink receives every item a BulkWriter gives up writing, because it
+failed permanently or ran out of retries.
+
+Items left unsent when the context is cancelled are not dead letters, as
+they can simply be written again; they are counted as Stats.ItemsAbandoned.
+
+It is called from the writer's goroutines, so must be safe for concurrent use.
+*/
+type DeadLetterSink interface {
+	DeadLetter(letter DeadLetter)
+}
+
+/*
+FileSink is a DeadLetterSink which appends each dead letter to a file as a
+line of JSON, which Replay can read back.
+*/
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	err  error
+}
+
+// Open a FileSink appending to path, creating the file if need be.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(file)
+	enc.SetEscapeHTML(false)
+	return &FileSink{file: file, enc: enc}, nil
+}
+
+func (s *FileSink) DeadLetter(letter DeadLetter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = s.enc.Encode(letter)
+	}
+}
+
+/*
+Close the file, returning the first error from writing to it if there was
+one, as records after a failed write are dropped.
+*/
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.file.Close(); s.err == nil {
+		s.err = err
+	}
+	return s.err
+}
+
+/*
+Replay queues every dead letter read from r onto a BulkWriter, as written by
+a FileSink, returning how many were queued.
+
+Replay doesn't wait for the writes; use the writer's results, Flush or
+CloseWait as usual.
+*/
+func Replay(r io.Reader, writer *BulkWriter) (int, error) {
+	dec := json.NewDecoder(r)
+	n := 0
+	for {
+		var letter DeadLetter
+		if err := dec.Decode(&letter); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		var err error
+		if letter.Op == OpDelete {
+			err = writer.Delete(letter.Item)
+		} else {
+			err = writer.Write(letter.Item)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,159 @@
+package bulk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+type memorySink struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (m *memorySink) DeadLetter(letter DeadLetter) {
+	m.mu.Lock()
+	m.letters = append(m.letters, letter)
+	m.mu.Unlock()
+}
+
+var conditionErr = &dynago.Error{
+	Type:          dynago.ErrorConditionFailed,
+	AmazonRawType: "ConditionalCheckFailedException",
+	Message:       "The conditional request failed",
+}
+
+func TestDeadLetters(t *testing.T) {
+	sink := &memorySink{}
+	backend := &fakeBackend{batchErr: func(int) error { return conditionErr }}
+	writer := newTestWriter(Config{DeadLetters: sink}, backend)
+	collect(writer)
+	writer.Write(dynago.Document{"Id": "a"})
+	writer.Delete(dynago.Document{"Id": "b"})
+	writer.CloseWait()
+
+	if len(sink.letters) != 2 {
+		t.Fatalf("Expected 2 dead letters, got %d", len(sink.letters))
+	}
+	put, del := sink.letters[0], sink.letters[1]
+	if put.Op != OpPut || put.Item["Id"] != "a" || del.Op != OpDelete || del.Item["Id"] != "b" {
+		t.Errorf("Unexpected dead letters %+v", sink.letters)
+	}
+	if put.ErrorType != "ConditionalCheckFailedException" || put.Message != conditionErr.Error() {
+		t.Errorf("Unexpected error details %+v", put)
+	}
+	if put.Attempts != 1 || put.Time.IsZero() {
+		t.Errorf("Unexpected attempts or time %+v", put)
+	}
+}
+
+func TestFileSinkReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &fakeBackend{batchErr: func(int) error { return conditionErr }}
+	writer := newTestWriter(Config{DeadLetters: sink}, backend)
+	collect(writer)
+	writer.Write(dynago.Document{"Id": "a"})
+	writer.Write(dynago.Document{"Id": "b"})
+	writer.Delete(dynago.Document{"Id": "c"})
+	writer.CloseWait()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	backend = &fakeBackend{}
+	writer = newTestWriter(Config{}, backend)
+	collect(writer)
+	n, err := Replay(f, writer)
+	writer.CloseWait()
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 replayed, got %d (%v)", n, err)
+	}
+	batch := backend.batches[0]
+	if len(batch) != 3 || batch[0].doc["Id"] != "a" || batch[1].doc["Id"] != "b" || !batch[2].delete || batch[2].doc["Id"] != "c" {
+		t.Errorf("Unexpected replayed batch %v", batch)
+	}
+}
+
+// Read back the dead letters written to a FileSink.
+func roundTrip(t *testing.T, letters ...DeadLetter) []dynago.Document {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, letter := range letters {
+		sink.DeadLetter(letter)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	backend := &fakeBackend{}
+	writer := newTestWriter(Config{}, backend)
+	collect(writer)
+	n, err := Replay(f, writer)
+	writer.CloseWait()
+	if err != nil || n != len(letters) {
+		t.Fatalf("Expected %d replayed, got %d (%v)", len(letters), n, err)
+	}
+	var docs []dynago.Document
+	for _, batch := range backend.batches {
+		for _, it := range batch {
+			docs = append(docs, it.doc)
+		}
+	}
+	return docs
+}
+
+func TestReplayLargeItem(t *testing.T) {
+	// Characters which JSON may escape as six bytes each.
+	body := strings.Repeat("<", 300*1024)
+	docs := roundTrip(t, DeadLetter{Op: OpPut, Item: dynago.Document{"Id": "a", "Body": body}})
+	if len(docs) != 1 || docs[0]["Body"] != body {
+		t.Errorf("Expected the large item to be replayed intact")
+	}
+}
+
+func TestReplayAttributeTypes(t *testing.T) {
+	item := dynago.Document{
+		"Id":     42,
+		"Active": true,
+		"List":   dynago.List{"x", 1},
+		"Nested": dynago.Document{"Name": "n", "Age": 7},
+	}
+	docs := roundTrip(t, DeadLetter{Op: OpPut, Item: item})
+	// Decoded values may be of other types, such as dynago.Number for ints.
+	if len(docs) != 1 || canonical(docs[0]) != canonical(item) {
+		t.Errorf("Expected %v, got %v", item, docs)
+	}
+}
+
+func TestCancelledNotDeadLettered(t *testing.T) {
+	sink := &memorySink{}
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := newTestWriterContext(ctx, Config{DeadLetters: sink}, &fakeBackend{})
+	writer.Write(dynago.Document{"Id": "a"})
+	cancel()
+	writer.CloseWait()
+	if len(sink.letters) != 0 {
+		t.Errorf("Expected no dead letters for abandoned items, got %v", sink.letters)
+	}
+}
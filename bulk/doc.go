@@ -8,5 +8,8 @@ from another datastore, or restore from backup, etc.
 it does this with BulkWriter, which will simultaneously execute batch
 operations in a number of goroutines, with automatic scale-back when the table
 starts returning provisioned throughput errors, and back-pressure on writes.
+
+Scale-back is enabled by setting MinConcurrency and MaxConcurrency around
+Concurrency in the Config; the current level is available from Concurrency.
 */
 package bulk
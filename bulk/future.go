@@ -0,0 +1,68 @@
+package bulk
+
+import (
+	"sync"
+)
+
+/*
+Future is the outcome of a single write or delete queued with WriteAsync or
+DeleteAsync.
+
+It resolves exactly once, after batching, retries of unprocessed items and
+any individual fallback write are done with the item.
+*/
+type Future struct {
+	once       sync.Once
+	done       chan struct{}
+	err        error
+	superseded bool
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Done returns a channel which is closed once the future has resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait for the future to resolve, returning the item's error if it failed.
+func (f *Future) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// Err returns the item's error once the future has resolved, and nil before.
+func (f *Future) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+/*
+Superseded waits for the future to resolve, then reports whether the item
+was replaced by a later write to the same key in the same batch, and so never
+sent itself. Such a future resolves without an error.
+*/
+func (f *Future) Superseded() bool {
+	<-f.done
+	return f.superseded
+}
+
+func (f *Future) supersede() {
+	f.once.Do(func() {
+		f.superseded = true
+		close(f.done)
+	})
+}
+
+func (f *Future) resolve(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+	})
+}
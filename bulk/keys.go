@@ -0,0 +1,154 @@
+package bulk
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+/*
+KeySchema looks up the names of a table's key attributes, hash key first,
+for use as Config.KeySchema.
+*/
+func KeySchema(client *dynago.Client, table string) ([]string, error) {
+	resp, err := client.DescribeTable(table)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, k := range resp.Table.KeySchema {
+		if k.KeyType == "HASH" {
+			names = append([]string{k.AttributeName}, names...)
+		} else {
+			names = append(names, k.AttributeName)
+		}
+	}
+	return names, nil
+}
+
+/*
+The key of a document, as a string which is equal for documents with equal
+keys. It is empty if there is no schema, or the document is missing any key
+attribute.
+*/
+func itemKey(doc dynago.Document, schema []string) string {
+	if len(schema) == 0 {
+		return ""
+	}
+	parts := make([]string, len(schema))
+	for i, name := range schema {
+		v, ok := doc[name]
+		if !ok {
+			return ""
+		}
+		parts[i] = canonical(v)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+/*
+A string which is equal for values DynamoDB would store the same way, so
+that, for example, an int and the dynago.Number decoded from it match, as do
+a []string and the dynago.StringSet it is sent as.
+*/
+func canonical(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return "S" + strconv.Quote(v)
+	case []byte:
+		return "B" + strconv.Quote(string(v))
+	case dynago.Number:
+		return "N" + canonicalNumber(string(v))
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return "N" + canonicalNumber(fmt.Sprint(v))
+	case dynago.StringSet:
+		return canonicalSet("SS", []string(v), strconv.Quote)
+	case []string:
+		return canonicalSet("SS", v, strconv.Quote)
+	case dynago.NumberSet:
+		return canonicalSet("NS", []string(v), canonicalNumber)
+	case dynago.BinarySet:
+		strs := make([]string, len(v))
+		for i, b := range v {
+			strs[i] = string(b)
+		}
+		return canonicalSet("BS", strs, strconv.Quote)
+	case dynago.List:
+		return canonicalList(v)
+	case []interface{}:
+		return canonicalList(v)
+	case dynago.Document:
+		return canonicalMap(v)
+	case map[string]interface{}:
+		return canonicalMap(v)
+	default:
+		return fmt.Sprintf("%T:%v", v, v)
+	}
+}
+
+// Numbers are compared by value, so "1.50" and 1.5 are the same.
+func canonicalNumber(n string) string {
+	if r, ok := new(big.Rat).SetString(n); ok {
+		return r.RatString()
+	}
+	return n
+}
+
+// Sets are unordered.
+func canonicalSet(tag string, members []string, canon func(string) string) string {
+	parts := make([]string, len(members))
+	for i, m := range members {
+		parts[i] = canon(m)
+	}
+	sort.Strings(parts)
+	return tag + "[" + strings.Join(parts, ",") + "]"
+}
+
+func canonicalList(list []interface{}) string {
+	parts := make([]string, len(list))
+	for i, v := range list {
+		parts[i] = canonical(v)
+	}
+	return "L[" + strings.Join(parts, ",") + "]"
+}
+
+// Attributes which are never sent, such as empty strings, are left out.
+func canonicalMap(m map[string]interface{}) string {
+	names := make([]string, 0, len(m))
+	for name, v := range m {
+		if !omitted(v) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = strconv.Quote(name) + ":" + canonical(m[name])
+	}
+	return "M{" + strings.Join(parts, ",") + "}"
+}
+
+// Whether dynago leaves out an attribute with this value when encoding.
+func omitted(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []byte:
+		return len(v) == 0
+	case []string:
+		return len(v) == 0
+	case dynago.StringSet:
+		return len(v) == 0
+	case dynago.NumberSet:
+		return len(v) == 0
+	case dynago.BinarySet:
+		return len(v) == 0
+	}
+	return false
+}
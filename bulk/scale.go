@@ -0,0 +1,80 @@
+package bulk
+
+import (
+	"sync"
+)
+
+/*
+Gates how many workers may write at once, between a minimum and a maximum.
+
+The limit is halved when batches are pushed back with unprocessed items or
+throttling errors, at most once per limit's worth of batches so one burst of
+throttling doesn't take it straight to the minimum. It grows by one after a
+limit's worth of fully successful batches in a row.
+*/
+type scaler struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	min, max  int
+	limit     int
+	active    int
+	successes int // Fully successful batches in a row
+	since     int // Batches finished since the limit was last cut
+}
+
+func newScaler(min, max, initial int) *scaler {
+	s := &scaler{min: min, max: max, limit: initial, since: initial}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Wait for a turn to write.
+func (s *scaler) acquire() {
+	s.mu.Lock()
+	for s.active >= s.limit {
+		s.cond.Wait()
+	}
+	s.active++
+	s.mu.Unlock()
+}
+
+func (s *scaler) release() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// Record a batch which was written in full.
+func (s *scaler) succeeded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since++
+	s.successes++
+	if s.successes >= s.limit && s.limit < s.max {
+		s.limit++
+		s.successes = 0
+		s.cond.Signal()
+	}
+}
+
+// Record a batch which was pushed back by DynamoDB.
+func (s *scaler) pushedBack() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since++
+	s.successes = 0
+	if s.since >= s.limit && s.limit > s.min {
+		s.limit /= 2
+		if s.limit < s.min {
+			s.limit = s.min
+		}
+		s.since = 0
+	}
+}
+
+func (s *scaler) current() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit
+}
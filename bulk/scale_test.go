@@ -0,0 +1,85 @@
+package bulk
+
+import (
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+func TestScaler(t *testing.T) {
+	s := newScaler(1, 8, 8)
+	s.pushedBack()
+	if s.current() != 4 {
+		t.Fatalf("Expected the limit to be halved to 4, got %d", s.current())
+	}
+	// Further push-backs from the same round don't cut it again.
+	s.pushedBack()
+	s.pushedBack()
+	s.pushedBack()
+	if s.current() != 4 {
+		t.Fatalf("Expected the limit to stay at 4, got %d", s.current())
+	}
+	s.pushedBack()
+	if s.current() != 2 {
+		t.Fatalf("Expected the limit to be halved to 2, got %d", s.current())
+	}
+	for i := 0; i < 2; i++ {
+		s.succeeded()
+	}
+	if s.current() != 3 {
+		t.Fatalf("Expected the limit to grow to 3, got %d", s.current())
+	}
+	for i := 0; i < 100; i++ {
+		s.succeeded()
+	}
+	if s.current() != 8 {
+		t.Fatalf("Expected the limit to grow to the maximum, got %d", s.current())
+	}
+	for i := 0; i < 100; i++ {
+		s.pushedBack()
+	}
+	if s.current() != 1 {
+		t.Fatalf("Expected the limit to shrink to the minimum, got %d", s.current())
+	}
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	pushBack := true
+	backend := &fakeBackend{unprocessed: func(items []*item) []*item {
+		if pushBack {
+			return items[len(items)-1:]
+		}
+		return nil
+	}}
+	writer := newTestWriter(Config{Concurrency: 4, MinConcurrency: 1, MaxConcurrency: 6, PerWrite: 2}, backend)
+	collect(writer)
+	if writer.Concurrency() != 4 {
+		t.Fatalf("Expected to start at 4, got %d", writer.Concurrency())
+	}
+	for i := 0; i < 40; i++ {
+		writer.Write(dynago.Document{"Id": i})
+	}
+	writer.Flush()
+	if writer.Concurrency() != 1 {
+		t.Errorf("Expected to scale back to 1, got %d", writer.Concurrency())
+	}
+	backend.mu.Lock()
+	pushBack = false
+	backend.mu.Unlock()
+	for i := 0; i < 100; i++ {
+		writer.Write(dynago.Document{"Id": i})
+	}
+	writer.Flush()
+	if writer.Concurrency() != 6 {
+		t.Errorf("Expected to scale up to 6, got %d", writer.Concurrency())
+	}
+	writer.CloseWait()
+}
+
+func TestFixedConcurrencyByDefault(t *testing.T) {
+	writer := newTestWriter(Config{Concurrency: 3}, &fakeBackend{})
+	if writer.Concurrency() != 3 {
+		t.Errorf("Expected concurrency 3, got %d", writer.Concurrency())
+	}
+	writer.CloseWait()
+}
@@ -0,0 +1,138 @@
+package bulk
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// Limits DynamoDB places on writes.
+const (
+	MaxItemSize    = 400 * 1024       // The largest item DynamoDB will store
+	MaxRequestSize = 16 * 1024 * 1024 // The largest BatchWriteItem request
+)
+
+// Room for the PutRequest or DeleteRequest wrapping each item in a batch.
+const itemOverhead = 32
+
+// ItemTooLargeError is the Result error for items over MaxItemSize, which are never sent.
+type ItemTooLargeError struct {
+	Size int // The item's size, as worked out by ItemSize
+}
+
+func (e *ItemTooLargeError) Error() string {
+	return fmt.Sprintf("bulk: item is %d bytes, over the %d KB DynamoDB item size limit", e.Size, MaxItemSize/1024)
+}
+
+/*
+ItemSize works out the size of a document the way DynamoDB does when
+applying the item size limit and charging write capacity.
+
+Each attribute counts the length of its name plus the size of its value.
+Strings and binary values count their length in bytes, numbers one byte per
+two significant digits plus one, and booleans and nulls one byte. Lists and
+maps count 3 bytes plus one per element on top of their contents.
+*/
+func ItemSize(doc dynago.Document) int {
+	size := 0
+	for name, v := range doc {
+		size += len(name) + valueSize(v)
+	}
+	return size
+}
+
+func valueSize(v interface{}) int {
+	switch v := v.(type) {
+	case nil, bool:
+		return 1
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	case dynago.Number:
+		return numberSize(string(v))
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return numberSize(fmt.Sprint(v))
+	case dynago.StringSet:
+		size := 0
+		for _, s := range v {
+			size += len(s)
+		}
+		return size
+	case dynago.NumberSet:
+		size := 0
+		for _, n := range v {
+			size += numberSize(n)
+		}
+		return size
+	case dynago.BinarySet:
+		size := 0
+		for _, b := range v {
+			size += len(b)
+		}
+		return size
+	case dynago.List:
+		return listSize(v)
+	case []interface{}:
+		return listSize(v)
+	case dynago.Document:
+		return mapSize(v)
+	case map[string]interface{}:
+		return mapSize(v)
+	default:
+		// Some other type dynago knows how to encode; go by its encoding.
+		enc, _ := json.Marshal(v)
+		return len(enc)
+	}
+}
+
+func listSize(list []interface{}) int {
+	size := 3
+	for _, v := range list {
+		size += valueSize(v) + 1
+	}
+	return size
+}
+
+func mapSize(m map[string]interface{}) int {
+	size := 3
+	for name, v := range m {
+		size += len(name) + valueSize(v) + 1
+	}
+	return size
+}
+
+// One byte per two significant digits, plus one.
+func numberSize(n string) int {
+	if i := strings.IndexAny(n, "eE"); i >= 0 {
+		n = n[:i]
+	}
+	n = strings.TrimLeft(n, "+-")
+	n = strings.Replace(n, ".", "", 1)
+	n = strings.Trim(n, "0")
+	return (len(n)+1)/2 + 1
+}
+
+// The write capacity units an item of the given size uses: one per KB or part.
+func writeUnits(itemSize int) float64 {
+	return math.Max(1, math.Ceil(float64(itemSize)/1024))
+}
+
+// The size an item takes up in a BatchWriteItem request.
+func requestSize(doc dynago.Document) int {
+	enc, _ := json.Marshal(doc)
+	return len(enc) + itemOverhead
+}
+
+// Work out the room and write capacity the item takes up.
+func (it *item) measure() {
+	it.itemSize = ItemSize(it.doc)
+	it.size = requestSize(it.doc)
+	it.units = 1
+	if !it.delete {
+		it.units = writeUnits(it.itemSize)
+	}
+}
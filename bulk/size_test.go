@@ -0,0 +1,93 @@
+package bulk
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+func TestItemSize(t *testing.T) {
+	cases := []struct {
+		doc  dynago.Document
+		size int
+	}{
+		{dynago.Document{"Name": "abc"}, 4 + 3},
+		{dynago.Document{"Id": 12345}, 2 + 4},
+		{dynago.Document{"Id": dynago.Number("-0.0500")}, 2 + 2},
+		{dynago.Document{"Ok": true, "No": nil}, 2 + 1 + 2 + 1},
+		{dynago.Document{"B": []byte{1, 2, 3}}, 1 + 3},
+		{dynago.Document{"S": dynago.StringSet{"ab", "c"}}, 1 + 3},
+		{dynago.Document{"L": dynago.List{"ab", 1}}, 1 + 3 + (2 + 1) + (2 + 1)},
+		{dynago.Document{"M": dynago.Document{"k": "v"}}, 1 + 3 + (1 + 1 + 1)},
+	}
+	for _, c := range cases {
+		if size := ItemSize(c.doc); size != c.size {
+			t.Errorf("ItemSize(%v) = %d, expected %d", c.doc, size, c.size)
+		}
+	}
+}
+
+func TestWriteUnits(t *testing.T) {
+	for size, units := range map[int]float64{0: 1, 1: 1, 1024: 1, 1025: 2, 400 * 1024: 400} {
+		if u := writeUnits(size); u != units {
+			t.Errorf("writeUnits(%d) = %v, expected %v", size, u, units)
+		}
+	}
+}
+
+func TestOversizedItemRejected(t *testing.T) {
+	backend := &fakeBackend{}
+	writer := newTestWriter(Config{}, backend)
+	results := collect(writer)
+	big := dynago.Document{"Id": 1, "Body": strings.Repeat("x", MaxItemSize)}
+	if err := writer.Write(big); err != nil {
+		t.Errorf("Expected the write to be accepted, got %v", err)
+	}
+	if _, ok := writer.DeleteAsync(big).Wait().(*ItemTooLargeError); !ok {
+		t.Errorf("Expected the async delete to fail as too large")
+	}
+	writer.Write(dynago.Document{"Id": 2})
+	writer.CloseWait()
+
+	var rejected *Result
+	r := results()
+	for i := range r {
+		if r[i].Error != nil {
+			rejected = &r[i]
+		}
+	}
+	if len(r) != 2 || rejected == nil || len(rejected.Documents) != 1 || rejected.Documents[0]["Id"] != 1 {
+		t.Fatalf("Expected the large document reported failed, got %v", r)
+	}
+	if e, ok := rejected.Error.(*ItemTooLargeError); !ok || e.Size <= MaxItemSize || !strings.Contains(e.Error(), "400") {
+		t.Errorf("Expected a too large error, got %v", rejected.Error)
+	}
+	if len(backend.batches) != 1 || len(backend.batches[0]) != 1 {
+		t.Errorf("Expected only the small document to be sent")
+	}
+	if n := writer.Stats().PermanentFailures; n != 2 {
+		t.Errorf("Expected both large items counted as failed, got %d", n)
+	}
+}
+
+func TestBatchesLimitedByBytes(t *testing.T) {
+	backend := &fakeBackend{}
+	doc := func(i int) dynago.Document {
+		return dynago.Document{"Id": i, "Body": strings.Repeat("x", 100)}
+	}
+	size := requestSize(doc(0))
+	writer := newTestWriter(Config{PerWrite: 25, MaxBatchBytes: size*3 + 1}, backend)
+	collect(writer)
+	for i := 0; i < 7; i++ {
+		writer.Write(doc(i))
+	}
+	writer.CloseWait()
+	var sizes []int
+	for _, batch := range backend.batches {
+		sizes = append(sizes, len(batch))
+	}
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Errorf("Expected batches of 3, 3 and 1, got %v", sizes)
+	}
+}
@@ -0,0 +1,61 @@
+package bulk
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/crast/dynatools/internal"
+)
+
+// Stats is a snapshot of a BulkWriter's progress.
+type Stats struct {
+	ItemsQueued       int64 // Items accepted by Write, Delete and their async forms
+	ItemsWritten      int64 // Documents put successfully
+	ItemsDeleted      int64 // Keys deleted successfully
+	ItemsSuperseded   int64 // Items replaced by a later write to the same key
+	PermanentFailures int64 // Items which failed to write
+	ItemsAbandoned    int64 // Items left unwritten when the context was cancelled
+	BytesWritten      int64 // Size of the documents put, as worked out by ItemSize
+
+	BatchesSent        int64 // BatchWriteItem requests made
+	UnprocessedRetries int64 // Items handed back unprocessed, to be tried again
+	IndividualWrites   int64 // PutItem and DeleteItem requests made as a fallback
+	Throttles          int64 // Throttling errors from any request
+
+	// Percentiles of BatchWriteItem latency, over the most recent batches.
+	BatchLatencyP50 time.Duration
+	BatchLatencyP90 time.Duration
+	BatchLatencyP99 time.Duration
+}
+
+// How many batch latencies to keep for percentiles.
+const latencyWindow = 1000
+
+// The live counters behind Stats.
+type counters struct {
+	queued, written, deleted, superseded, failed, abandoned, bytes int64
+	batches, unprocessed, individual, throttles                    int64
+	latency                                                        *internal.LatencyWindow
+}
+
+// Stats returns a snapshot of the writer's counters so far.
+func (b *BulkWriter) Stats() Stats {
+	c := &b.counters
+	p := c.latency.Percentiles(.5, .9, .99)
+	return Stats{
+		ItemsQueued:        atomic.LoadInt64(&c.queued),
+		ItemsWritten:       atomic.LoadInt64(&c.written),
+		ItemsDeleted:       atomic.LoadInt64(&c.deleted),
+		ItemsSuperseded:    atomic.LoadInt64(&c.superseded),
+		PermanentFailures:  atomic.LoadInt64(&c.failed),
+		ItemsAbandoned:     atomic.LoadInt64(&c.abandoned),
+		BytesWritten:       atomic.LoadInt64(&c.bytes),
+		BatchesSent:        atomic.LoadInt64(&c.batches),
+		UnprocessedRetries: atomic.LoadInt64(&c.unprocessed),
+		IndividualWrites:   atomic.LoadInt64(&c.individual),
+		Throttles:          atomic.LoadInt64(&c.throttles),
+		BatchLatencyP50:    p[0],
+		BatchLatencyP90:    p[1],
+		BatchLatencyP99:    p[2],
+	}
+}
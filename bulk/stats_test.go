@@ -0,0 +1,90 @@
+package bulk
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+func TestStats(t *testing.T) {
+	backend := &fakeBackend{
+		batchErr: func(n int) error {
+			if n == 1 {
+				return &dynago.Error{Type: dynago.ErrorThroughputExceeded}
+			}
+			return nil
+		},
+		unprocessed: unprocessedOnce(),
+	}
+	writer := newTestWriter(Config{PerWrite: 4, KeySchema: []string{"Id"}}, backend)
+	collect(writer)
+	writer.Write(dynago.Document{"Id": 0})
+	writer.Write(dynago.Document{"Id": 1})
+	writer.Write(dynago.Document{"Id": 1, "Name": "again"})
+	writer.Write(dynago.Document{"Id": 2})
+	writer.Delete(dynago.Document{"Id": 3})
+	// Never sent, so only counted as failed.
+	writer.Write(dynago.Document{"Id": 4, "Body": strings.Repeat("x", MaxItemSize)})
+	writer.CloseWait()
+
+	stats := writer.Stats()
+	expected := Stats{
+		ItemsQueued:        6,
+		ItemsWritten:       3,
+		ItemsDeleted:       1,
+		ItemsSuperseded:    1,
+		BatchesSent:        2,
+		UnprocessedRetries: 2,
+		IndividualWrites:   2,
+		Throttles:          1,
+		PermanentFailures:  1,
+	}
+	if stats.BytesWritten <= 0 {
+		t.Errorf("Expected bytes written to be counted")
+	}
+	if stats.BatchLatencyP99 < stats.BatchLatencyP50 {
+		t.Errorf("Expected P99 latency of at least P50")
+	}
+	stats.BytesWritten = 0
+	stats.BatchLatencyP50, stats.BatchLatencyP90, stats.BatchLatencyP99 = 0, 0, 0
+	if stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestStatsFailures(t *testing.T) {
+	backend := &fakeBackend{
+		gate: make(chan struct{}),
+		batchErr: func(n int) error {
+			return &dynago.Error{Type: dynago.ErrorConditionFailed}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := newTestWriterContext(ctx, Config{PerWrite: 2}, backend)
+	writer.Write(dynago.Document{"Id": 1})
+	writer.Write(dynago.Document{"Id": 2})
+	waitFor(t, func() bool { return backend.batchCount() == 1 })
+	writer.Write(dynago.Document{"Id": 3})
+	cancel()
+	close(backend.gate)
+	writer.CloseWait()
+
+	stats := writer.Stats()
+	if stats.PermanentFailures != 2 || stats.ItemsAbandoned != 1 || stats.ItemsWritten != 0 || stats.BytesWritten != 0 {
+		t.Errorf("Expected 2 failures and 1 abandoned, got %+v", stats)
+	}
+}
+
+func TestBytesWrittenOnlyPuts(t *testing.T) {
+	writer := newTestWriter(Config{}, &fakeBackend{})
+	collect(writer)
+	doc := dynago.Document{"Id": 1, "Name": "x"}
+	writer.Write(doc)
+	writer.Delete(dynago.Document{"Id": 2})
+	writer.CloseWait()
+	if n := writer.Stats().BytesWritten; n != int64(ItemSize(doc)) {
+		t.Errorf("Expected only the put to count towards bytes written, got %d", n)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+package capacity keeps account of the read and write capacity used.
+
+A Tracker wraps an AwsRequester, asks DynamoDB to return the consumed
+capacity on every request which doesn't already ask for it, and keeps running
+totals per table, per index and per operation. Snapshot can be called at any
+time to get the totals so far, for example to log them periodically during a
+bulk load or while consuming a stream.
+
+Usage:
+
+	tracker := &capacity.Tracker{}
+	tracker.Install(executor)
+	// ... later ...
+	log.Printf("Capacity used: %s", tracker.Snapshot())
+*/
+package capacity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/crast/dynatools/internal"
+	"github.com/crast/dynatools/middleware"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// Operations which can return consumed capacity, and whether they are reads.
+var operations = map[string]bool{
+	"GetItem":            true,
+	"BatchGetItem":       true,
+	"Query":              true,
+	"Scan":               true,
+	"TransactGetItems":   true,
+	"PutItem":            false,
+	"UpdateItem":         false,
+	"DeleteItem":         false,
+	"BatchWriteItem":     false,
+	"TransactWriteItems": false,
+}
+
+// Units is an amount of consumed capacity.
+type Units struct {
+	Read  float64 // Read capacity units
+	Write float64 // Write capacity units
+}
+
+func (u Units) Total() float64 {
+	return u.Read + u.Write
+}
+
+func (u Units) String() string {
+	return fmt.Sprintf("%.1f RCU, %.1f WCU", u.Read, u.Write)
+}
+
+// Report is a snapshot of the capacity consumed.
+type Report struct {
+	Tables     map[string]Units            // Keyed by table, including the table's indexes.
+	Indexes    map[string]map[string]Units // Keyed by table, then index name.
+	Operations map[string]Units            // Keyed by operation, like "Query".
+}
+
+// String gives a one-line summary of the report, sorted by table name.
+func (r Report) String() string {
+	names := make([]string, 0, len(r.Tables))
+	for name := range r.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s: %s", name, r.Tables[name])
+	}
+	return strings.Join(parts, "; ")
+}
+
+/*
+Tracker is an AwsRequester which accounts for consumed capacity.
+
+If a request already sets ReturnConsumedCapacity it is left alone, even if
+it is NONE, so the Tracker only counts what it is given in that case.
+*/
+type Tracker struct {
+	Requester dynago.AwsRequester
+
+	mu     sync.Mutex
+	report Report
+}
+
+func (t *Tracker) MakeRequest(target string, body []byte) ([]byte, error) {
+	return t.makeRequest(context.Background(), t.Requester, target, body)
+}
+
+// MakeRequestContext is like MakeRequest, passing ctx on to the wrapped requester.
+func (t *Tracker) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return t.makeRequest(ctx, t.Requester, target, body)
+}
+
+// Snapshot returns a copy of the running totals.
+func (t *Tracker) Snapshot() Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := newReport()
+	for k, v := range t.report.Tables {
+		r.Tables[k] = v
+	}
+	for k, v := range t.report.Operations {
+		r.Operations[k] = v
+	}
+	for table, indexes := range t.report.Indexes {
+		r.Indexes[table] = make(map[string]Units, len(indexes))
+		for k, v := range indexes {
+			r.Indexes[table][k] = v
+		}
+	}
+	return r
+}
+
+// Reset all the running totals to zero.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	t.report = newReport()
+	t.mu.Unlock()
+}
+
+// Middleware returns a layer which adds to this Tracker's totals.
+func (t *Tracker) Middleware() middleware.Middleware {
+	return func(next dynago.AwsRequester) dynago.AwsRequester {
+		return &layer{t, next}
+	}
+}
+
+// Install to the executor as the "capacity" layer of its middleware chain.
+func (t *Tracker) Install(executor *dynago.AwsExecutor) {
+	middleware.Install(executor).Use(Name, t.Middleware())
+}
+
+// The name Tracker uses for itself in a middleware chain.
+const Name = "capacity"
+
+func newReport() Report {
+	return Report{
+		Tables:     make(map[string]Units),
+		Indexes:    make(map[string]map[string]Units),
+		Operations: make(map[string]Units),
+	}
+}
+
+func (t *Tracker) makeRequest(ctx context.Context, requester dynago.AwsRequester, target string, body []byte) ([]byte, error) {
+	op := internal.Operation(target)
+	isRead, ok := operations[op]
+	if ok {
+		body = injectReturn(body)
+	}
+	response, err := internal.MakeRequest(ctx, requester, target, body)
+	if ok && err == nil {
+		t.record(op, isRead, response)
+	}
+	return response, err
+}
+
+// Add ReturnConsumedCapacity=INDEXES to a request body which doesn't set it.
+func injectReturn(body []byte) []byte {
+	var req map[string]json.RawMessage
+	if json.Unmarshal(body, &req) != nil {
+		return body
+	}
+	if _, ok := req["ReturnConsumedCapacity"]; ok {
+		return body
+	}
+	req["ReturnConsumedCapacity"] = json.RawMessage(`"INDEXES"`)
+	newBody, err := json.Marshal(req)
+	if err != nil {
+		return body
+	}
+	return newBody
+}
+
+// The wire format of capacity units.
+type wireUnits struct {
+	CapacityUnits      float64
+	ReadCapacityUnits  float64
+	WriteCapacityUnits float64
+}
+
+// Split the units into reads and writes, if DynamoDB didn't do it for us.
+func (w wireUnits) units(isRead bool) Units {
+	if w.ReadCapacityUnits > 0 || w.WriteCapacityUnits > 0 {
+		return Units{Read: w.ReadCapacityUnits, Write: w.WriteCapacityUnits}
+	} else if isRead {
+		return Units{Read: w.CapacityUnits}
+	}
+	return Units{Write: w.CapacityUnits}
+}
+
+type consumedCapacity struct {
+	TableName string
+	wireUnits
+	LocalSecondaryIndexes  map[string]wireUnits
+	GlobalSecondaryIndexes map[string]wireUnits
+}
+
+// Parse ConsumedCapacity, which is an object for single-item operations and
+// a list for batches and transactions.
+func parseConsumed(response []byte) []consumedCapacity {
+	var resp struct {
+		ConsumedCapacity json.RawMessage
+	}
+	if json.Unmarshal(response, &resp) != nil || len(resp.ConsumedCapacity) == 0 {
+		return nil
+	}
+	var list []consumedCapacity
+	if json.Unmarshal(resp.ConsumedCapacity, &list) == nil {
+		return list
+	}
+	var single consumedCapacity
+	if json.Unmarshal(resp.ConsumedCapacity, &single) == nil {
+		return []consumedCapacity{single}
+	}
+	return nil
+}
+
+func (t *Tracker) record(op string, isRead bool, response []byte) {
+	consumed := parseConsumed(response)
+	if len(consumed) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.report.Tables == nil {
+		t.report = newReport()
+	}
+	for _, c := range consumed {
+		u := c.units(isRead)
+		t.report.Tables[c.TableName] = add(t.report.Tables[c.TableName], u)
+		t.report.Operations[op] = add(t.report.Operations[op], u)
+		for _, indexes := range []map[string]wireUnits{c.LocalSecondaryIndexes, c.GlobalSecondaryIndexes} {
+			for name, w := range indexes {
+				tableIndexes := t.report.Indexes[c.TableName]
+				if tableIndexes == nil {
+					tableIndexes = make(map[string]Units)
+					t.report.Indexes[c.TableName] = tableIndexes
+				}
+				tableIndexes[name] = add(tableIndexes[name], w.units(isRead))
+			}
+		}
+	}
+}
+
+func add(a, b Units) Units {
+	return Units{Read: a.Read + b.Read, Write: a.Write + b.Write}
+}
+
+type layer struct {
+	tracker *Tracker
+	next    dynago.AwsRequester
+}
+
+func (l *layer) MakeRequest(target string, body []byte) ([]byte, error) {
+	return l.tracker.makeRequest(context.Background(), l.next, target, body)
+}
+
+func (l *layer) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return l.tracker.makeRequest(ctx, l.next, target, body)
+}
@@ -0,0 +1,61 @@
+package capacity
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Checks the request asked for capacity, then answers with a canned response.
+type cannedRequester struct {
+	t        *testing.T
+	response string
+}
+
+func (c *cannedRequester) MakeRequest(target string, body []byte) ([]byte, error) {
+	var req map[string]interface{}
+	json.Unmarshal(body, &req)
+	if req["ReturnConsumedCapacity"] != "INDEXES" {
+		c.t.Errorf("Expected ReturnConsumedCapacity to be INDEXES, got %v", req["ReturnConsumedCapacity"])
+	}
+	return []byte(c.response), nil
+}
+
+func TestTracker(t *testing.T) {
+	requester := &cannedRequester{t: t}
+	tracker := &Tracker{Requester: requester}
+
+	requester.response = `{"Items":[],"ConsumedCapacity":{"TableName":"people","CapacityUnits":3,
+		"Table":{"CapacityUnits":2},"GlobalSecondaryIndexes":{"ByName":{"CapacityUnits":1}}}}`
+	tracker.MakeRequest("DynamoDB_20120810.Query", []byte(`{"TableName":"people"}`))
+
+	requester.response = `{"UnprocessedItems":{},"ConsumedCapacity":[
+		{"TableName":"people","CapacityUnits":10},
+		{"TableName":"pets","CapacityUnits":4}]}`
+	tracker.MakeRequest("DynamoDB_20120810.BatchWriteItem", []byte(`{"RequestItems":{}}`))
+
+	report := tracker.Snapshot()
+	if u := report.Tables["people"]; u.Read != 3 || u.Write != 10 {
+		t.Errorf("Unexpected units for people: %s", u)
+	}
+	if u := report.Indexes["people"]["ByName"]; u.Read != 1 || u.Write != 0 {
+		t.Errorf("Unexpected units for ByName: %s", u)
+	}
+	if u := report.Operations["BatchWriteItem"]; u.Total() != 14 {
+		t.Errorf("Expected 14 units for BatchWriteItem, got %s", u)
+	}
+	if s := report.String(); s != "people: 3.0 RCU, 10.0 WCU; pets: 0.0 RCU, 4.0 WCU" {
+		t.Errorf("Unexpected summary %s", s)
+	}
+
+	tracker.Reset()
+	if len(tracker.Snapshot().Tables) != 0 {
+		t.Errorf("Expected Reset to clear the totals")
+	}
+}
+
+func TestExistingReturnConsumedCapacity(t *testing.T) {
+	body := []byte(`{"TableName":"people","ReturnConsumedCapacity":"TOTAL"}`)
+	if string(injectReturn(body)) != string(body) {
+		t.Errorf("Expected body to be left alone")
+	}
+}
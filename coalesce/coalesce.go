@@ -0,0 +1,197 @@
+/*
+package coalesce collapses identical concurrent reads into one request.
+
+When many goroutines read the same hot key at the same time, a Coalescer
+sends only the first of the identical requests to DynamoDB, and every other
+caller waiting on it gets a copy of the same response.
+
+Requests are identical when they have the same target and the same body
+once it is normalized, so the order of keys in the JSON doesn't matter.
+Strongly consistent reads are never coalesced unless ConsistentReads is set,
+because a caller asking for one may need to see writes that happened after
+the in-flight request was sent.
+
+Usage:
+
+	c := &coalesce.Coalescer{}
+	c.Install(executor)
+	// ... later ...
+	stats := c.Stats()
+	log.Printf("%d of %d reads were coalesced", stats.Coalesced, stats.Requests)
+*/
+package coalesce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"github.com/crast/dynatools/internal"
+	"github.com/crast/dynatools/middleware"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// The operations which can be coalesced.
+var coalescable = map[string]bool{
+	"GetItem":      true,
+	"BatchGetItem": true,
+	"Query":        true,
+}
+
+// Stats counts the requests seen by a Coalescer.
+type Stats struct {
+	Requests  int64 // Read requests which could have been coalesced
+	Coalesced int64 // Requests answered by sharing another request's response
+}
+
+// Coalescer is an AwsRequester which coalesces identical concurrent reads.
+type Coalescer struct {
+	Requester dynago.AwsRequester
+
+	// Also coalesce strongly consistent reads.
+	ConsistentReads bool
+
+	mu        sync.Mutex
+	calls     map[string]*call
+	requests  int64
+	coalesced int64
+}
+
+type call struct {
+	done     chan struct{}
+	response []byte
+	err      error
+}
+
+func (c *Coalescer) MakeRequest(target string, body []byte) ([]byte, error) {
+	return c.makeRequest(context.Background(), c.Requester, target, body)
+}
+
+/*
+MakeRequestContext is like MakeRequest, but returns early if ctx is done.
+
+The shared request carries on regardless, as other callers may be waiting
+for it.
+*/
+func (c *Coalescer) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return c.makeRequest(ctx, c.Requester, target, body)
+}
+
+// Stats returns the counters so far.
+func (c *Coalescer) Stats() Stats {
+	return Stats{
+		Requests:  atomic.LoadInt64(&c.requests),
+		Coalesced: atomic.LoadInt64(&c.coalesced),
+	}
+}
+
+// Middleware returns a layer which coalesces reads through this Coalescer.
+func (c *Coalescer) Middleware() middleware.Middleware {
+	return func(next dynago.AwsRequester) dynago.AwsRequester {
+		return &layer{c, next}
+	}
+}
+
+// Install to the executor as the "coalesce" layer of its middleware chain.
+func (c *Coalescer) Install(executor *dynago.AwsExecutor) {
+	middleware.Install(executor).Use(Name, c.Middleware())
+}
+
+// The name Coalescer uses for itself in a middleware chain.
+const Name = "coalesce"
+
+func (c *Coalescer) makeRequest(ctx context.Context, requester dynago.AwsRequester, target string, body []byte) ([]byte, error) {
+	key, ok := c.key(target, body)
+	if !ok {
+		return internal.MakeRequest(ctx, requester, target, body)
+	}
+	atomic.AddInt64(&c.requests, 1)
+
+	c.mu.Lock()
+	cl := c.calls[key]
+	if cl != nil {
+		atomic.AddInt64(&c.coalesced, 1)
+	} else {
+		cl = &call{done: make(chan struct{})}
+		if c.calls == nil {
+			c.calls = make(map[string]*call)
+		}
+		c.calls[key] = cl
+		go c.run(cl, key, requester, target, body)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-cl.done:
+		// Each caller gets its own copy, in case it modifies the response.
+		return append([]byte(nil), cl.response...), cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Make the shared request, detached from any one caller's context.
+func (c *Coalescer) run(cl *call, key string, requester dynago.AwsRequester, target string, body []byte) {
+	cl.response, cl.err = requester.MakeRequest(target, body)
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(cl.done)
+}
+
+// Work out the key identifying a request, and whether it can be coalesced at all.
+func (c *Coalescer) key(target string, body []byte) (string, bool) {
+	if !coalescable[internal.Operation(target)] {
+		return "", false
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if dec.Decode(&v) != nil {
+		return "", false
+	}
+	if !c.ConsistentReads && consistent(v) {
+		return "", false
+	}
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	return target + "\x00" + string(normalized), true
+}
+
+// Look for ConsistentRead anywhere, as BatchGetItem has one per table.
+func consistent(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range v {
+			if k == "ConsistentRead" && inner == true {
+				return true
+			} else if consistent(inner) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, inner := range v {
+			if consistent(inner) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type layer struct {
+	coalescer *Coalescer
+	next      dynago.AwsRequester
+}
+
+func (l *layer) MakeRequest(target string, body []byte) ([]byte, error) {
+	return l.coalescer.makeRequest(context.Background(), l.next, target, body)
+}
+
+func (l *layer) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return l.coalescer.makeRequest(ctx, l.next, target, body)
+}
@@ -0,0 +1,74 @@
+package coalesce
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Blocks every request until release is closed.
+type gatedRequester struct {
+	release chan struct{}
+	calls   int32
+}
+
+func (g *gatedRequester) MakeRequest(target string, body []byte) ([]byte, error) {
+	atomic.AddInt32(&g.calls, 1)
+	<-g.release
+	return []byte(`{"Item":{}}`), nil
+}
+
+func runConcurrently(c *Coalescer, n int, bodies ...string) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.MakeRequest("DynamoDB_20120810.GetItem", []byte(bodies[i%len(bodies)]))
+		}(i)
+	}
+	for c.Stats().Requests < int64(n) {
+		time.Sleep(time.Millisecond)
+	}
+	close(c.Requester.(*gatedRequester).release)
+	wg.Wait()
+}
+
+func TestCoalescing(t *testing.T) {
+	requester := &gatedRequester{release: make(chan struct{})}
+	c := &Coalescer{Requester: requester}
+	runConcurrently(c, 10,
+		`{"TableName":"people","Key":{"Id":{"N":"1"}}}`,
+		`{"Key":{"Id":{"N":"1"}},"TableName":"people"}`,
+	)
+	if calls := atomic.LoadInt32(&requester.calls); calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+	if stats := c.Stats(); stats.Coalesced != 9 {
+		t.Errorf("Expected 9 coalesced, got %d", stats.Coalesced)
+	}
+}
+
+func TestConsistentReadsNotCoalesced(t *testing.T) {
+	requester := &gatedRequester{release: make(chan struct{})}
+	c := &Coalescer{Requester: requester}
+	go func() {
+		for atomic.LoadInt32(&requester.calls) < 3 {
+			time.Sleep(time.Millisecond)
+		}
+		close(requester.release)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.MakeRequest("DynamoDB_20120810.GetItem", []byte(`{"TableName":"people","ConsistentRead":true}`))
+		}()
+	}
+	wg.Wait()
+	if stats := c.Stats(); stats.Requests != 0 {
+		t.Errorf("Expected consistent reads to be passed straight through, got %d", stats.Requests)
+	}
+}
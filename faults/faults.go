@@ -0,0 +1,291 @@
+/*
+package faults injects failures into DynamoDB requests for chaos testing.
+
+An Injector wraps an AwsRequester and, following a list of rules, makes some
+requests fail with throttling or service errors, adds latency, or leaves part
+of a BatchWriteItem unprocessed. This makes it possible to check that retry
+handling in code like bulk.BulkWriter and streamer behaves correctly without
+waiting for real throttling to happen.
+
+Usage:
+
+	injector := &faults.Injector{
+		Rules: []*faults.Rule{
+			{Target: "BatchWriteItem", Probability: 0.2, Unprocessed: 0.5},
+			{Target: "BatchWriteItem", Every: 10, Error: faults.Err(dynago.ErrorThroughputExceeded)},
+			{Probability: 0.05, Latency: 200 * time.Millisecond},
+		},
+	}
+	injector.Install(executor)
+*/
+package faults
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crast/dynatools/internal"
+	"github.com/crast/dynatools/middleware"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// Amazon's names for the errors we know how to fake.
+var rawTypes = map[dynago.AmazonError]string{
+	dynago.ErrorThrottling:         "ThrottlingException",
+	dynago.ErrorThroughputExceeded: "ProvisionedThroughputExceededException",
+	dynago.ErrorInternalFailure:    "InternalFailure",
+	dynago.ErrorServiceUnavailable: "ServiceUnavailable",
+}
+
+// Err makes an error of the given type, for use in a Rule.
+func Err(t dynago.AmazonError) *dynago.Error {
+	return &dynago.Error{
+		Type:          t,
+		AmazonRawType: rawTypes[t],
+		Message:       "injected fault: " + rawTypes[t],
+	}
+}
+
+/*
+Rule describes a fault to inject.
+
+A rule fires either randomly, with the given Probability, or on a fixed
+schedule of every Nth matching request. When it fires, it adds its Latency,
+and then either fails the request with Error or leaves the Unprocessed
+fraction of a BatchWriteItem's items unprocessed.
+*/
+type Rule struct {
+	// Operation name like "BatchWriteItem" or the full target. Empty matches everything.
+	Target string
+
+	Probability float64 // Chance from 0 to 1 of firing on each matching request
+	Every       int     // Alternatively, fire on every Nth matching request
+	Skip        int     // Don't fire for this many matching requests at the start
+	Limit       int     // Stop firing after this many times. Zero is unlimited
+
+	Latency     time.Duration // Delay added before the request is made
+	Error       *dynago.Error // Error to fail the request with
+	Unprocessed float64       // Fraction of BatchWriteItem items to leave unprocessed
+}
+
+func (r *Rule) matches(target string) bool {
+	return r.Target == "" || r.Target == target || r.Target == internal.Operation(target)
+}
+
+/*
+Injector is an AwsRequester which injects faults into the requests going
+through it. Rules are checked in order; when several fire for one request
+their latencies add up and the first error wins.
+*/
+type Injector struct {
+	Requester dynago.AwsRequester
+	Rules     []*Rule
+	Seed      int64 // Seed for the random source, for repeatable runs.
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	seen    map[*Rule]int
+	fired   map[*Rule]int
+	stopped bool
+}
+
+func (inj *Injector) MakeRequest(target string, body []byte) ([]byte, error) {
+	return inj.makeRequest(context.Background(), inj.Requester, target, body)
+}
+
+// MakeRequestContext is like MakeRequest; injected latency ends early if ctx is done.
+func (inj *Injector) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return inj.makeRequest(ctx, inj.Requester, target, body)
+}
+
+// Fired returns how many times a rule has fired so far.
+func (inj *Injector) Fired(rule *Rule) int {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.fired[rule]
+}
+
+// Stop or resume injecting faults, without uninstalling the injector.
+func (inj *Injector) SetEnabled(enabled bool) {
+	inj.mu.Lock()
+	inj.stopped = !enabled
+	inj.mu.Unlock()
+}
+
+// Middleware returns a layer which injects faults using this Injector's rules.
+func (inj *Injector) Middleware() middleware.Middleware {
+	return func(next dynago.AwsRequester) dynago.AwsRequester {
+		return &layer{inj, next}
+	}
+}
+
+// Install to the executor as the "faults" layer of its middleware chain.
+func (inj *Injector) Install(executor *dynago.AwsExecutor) {
+	middleware.Install(executor).Use(Name, inj.Middleware())
+}
+
+// The name Injector uses for itself in a middleware chain.
+const Name = "faults"
+
+func (inj *Injector) makeRequest(ctx context.Context, requester dynago.AwsRequester, target string, body []byte) ([]byte, error) {
+	fault := inj.decide(target)
+	if fault.latency > 0 {
+		timer := time.NewTimer(fault.latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	if fault.err != nil {
+		e := *fault.err
+		return nil, &e
+	}
+	if fault.unprocessed > 0 && internal.Operation(target) == "BatchWriteItem" {
+		return inj.partialBatch(ctx, requester, target, body, fault.unprocessed)
+	}
+	return internal.MakeRequest(ctx, requester, target, body)
+}
+
+type fault struct {
+	latency     time.Duration
+	err         *dynago.Error
+	unprocessed float64
+}
+
+// Work out which rules fire for this request.
+func (inj *Injector) decide(target string) (f fault) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if inj.stopped {
+		return
+	}
+	if inj.rand == nil {
+		seed := inj.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		inj.rand = rand.New(rand.NewSource(seed))
+		inj.seen = make(map[*Rule]int)
+		inj.fired = make(map[*Rule]int)
+	}
+	for _, rule := range inj.Rules {
+		if !rule.matches(target) {
+			continue
+		}
+		inj.seen[rule]++
+		n := inj.seen[rule] - rule.Skip
+		if n <= 0 || (rule.Limit > 0 && inj.fired[rule] >= rule.Limit) {
+			continue
+		}
+		if rule.Every > 0 {
+			if n%rule.Every != 0 {
+				continue
+			}
+		} else if inj.rand.Float64() >= rule.Probability {
+			continue
+		}
+		inj.fired[rule]++
+		f.latency += rule.Latency
+		if f.err == nil {
+			f.err = rule.Error
+		}
+		if rule.Unprocessed > f.unprocessed {
+			f.unprocessed = rule.Unprocessed
+		}
+	}
+	return
+}
+
+// Held back items, keyed by table.
+type batchItems map[string][]json.RawMessage
+
+/*
+Pull a fraction of the items out of a BatchWriteItem request, send the rest,
+and then add the held-back items to the response's UnprocessedItems. If the
+response can't be decoded to add them, the request fails, as the held-back
+items would otherwise be silently dropped.
+*/
+func (inj *Injector) partialBatch(ctx context.Context, requester dynago.AwsRequester, target string, body []byte, fraction float64) ([]byte, error) {
+	var request map[string]json.RawMessage
+	var items batchItems
+	if json.Unmarshal(body, &request) != nil || json.Unmarshal(request["RequestItems"], &items) != nil {
+		return internal.MakeRequest(ctx, requester, target, body)
+	}
+
+	keep, held := inj.split(items, fraction)
+	if len(held) == 0 {
+		return internal.MakeRequest(ctx, requester, target, body)
+	}
+	var response map[string]json.RawMessage
+	if len(keep) > 0 {
+		request["RequestItems"], _ = json.Marshal(keep)
+		newBody, _ := json.Marshal(request)
+		resp, err := internal.MakeRequest(ctx, requester, target, newBody)
+		if err != nil {
+			return resp, err
+		}
+		if err := json.Unmarshal(resp, &response); err != nil {
+			return nil, fmt.Errorf("faults: decoding BatchWriteItem response: %w", err)
+		}
+	}
+	if response == nil {
+		response = map[string]json.RawMessage{}
+	}
+
+	unprocessed := batchItems{}
+	if raw, ok := response["UnprocessedItems"]; ok {
+		if err := json.Unmarshal(raw, &unprocessed); err != nil {
+			return nil, fmt.Errorf("faults: decoding UnprocessedItems: %w", err)
+		}
+	}
+	for table, entries := range held {
+		unprocessed[table] = append(unprocessed[table], entries...)
+	}
+	response["UnprocessedItems"], _ = json.Marshal(unprocessed)
+	return json.Marshal(response)
+}
+
+/*
+Randomly choose about fraction of the items to hold back. Tables are gone
+through in order so the same Seed holds back the same items.
+*/
+func (inj *Injector) split(items batchItems, fraction float64) (keep, held batchItems) {
+	keep, held = batchItems{}, batchItems{}
+	tables := make([]string, 0, len(items))
+	for table := range items {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	for _, table := range tables {
+		for _, entry := range items[table] {
+			if inj.rand.Float64() < fraction {
+				held[table] = append(held[table], entry)
+			} else {
+				keep[table] = append(keep[table], entry)
+			}
+		}
+	}
+	return
+}
+
+type layer struct {
+	injector *Injector
+	next     dynago.AwsRequester
+}
+
+func (l *layer) MakeRequest(target string, body []byte) ([]byte, error) {
+	return l.injector.makeRequest(context.Background(), l.next, target, body)
+}
+
+func (l *layer) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return l.injector.makeRequest(ctx, l.next, target, body)
+}
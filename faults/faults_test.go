@@ -0,0 +1,132 @@
+package faults
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// Answers every BatchWriteItem as fully processed, and counts the items sent.
+type batchRequester struct {
+	calls int
+	items int
+}
+
+func (b *batchRequester) MakeRequest(target string, body []byte) ([]byte, error) {
+	b.calls++
+	var req struct {
+		RequestItems map[string][]json.RawMessage
+	}
+	json.Unmarshal(body, &req)
+	for _, entries := range req.RequestItems {
+		b.items += len(entries)
+	}
+	return []byte(`{"UnprocessedItems":{}}`), nil
+}
+
+const batchBody = `{"RequestItems":{"people":[
+	{"PutRequest":{"Item":{"Id":{"N":"1"}}}},
+	{"PutRequest":{"Item":{"Id":{"N":"2"}}}},
+	{"PutRequest":{"Item":{"Id":{"N":"3"}}}},
+	{"DeleteRequest":{"Key":{"Id":{"N":"4"}}}}
+]}}`
+
+func TestScheduledErrors(t *testing.T) {
+	requester := &batchRequester{}
+	rule := &Rule{Target: "GetItem", Every: 3, Error: Err(dynago.ErrorThrottling)}
+	inj := &Injector{Requester: requester, Rules: []*Rule{rule}}
+	for i := 1; i <= 9; i++ {
+		_, err := inj.MakeRequest("DynamoDB_20120810.GetItem", []byte("{}"))
+		if i%3 == 0 {
+			if e, ok := err.(*dynago.Error); !ok || e.Type != dynago.ErrorThrottling {
+				t.Errorf("Request %d: Expected throttling error, got %v", i, err)
+			}
+		} else if err != nil {
+			t.Errorf("Request %d: Unexpected error %v", i, err)
+		}
+	}
+	inj.MakeRequest("DynamoDB_20120810.PutItem", []byte("{}"))
+	if inj.Fired(rule) != 3 || requester.calls != 7 {
+		t.Errorf("Expected 3 firings and 7 calls, got %d and %d", inj.Fired(rule), requester.calls)
+	}
+}
+
+func TestUnprocessedItems(t *testing.T) {
+	requester := &batchRequester{}
+	inj := &Injector{
+		Requester: requester,
+		Seed:      42,
+		Rules:     []*Rule{{Target: "BatchWriteItem", Every: 1, Unprocessed: 0.5}},
+	}
+	total := 0
+	for i := 0; i < 20; i++ {
+		resp, err := inj.MakeRequest("DynamoDB_20120810.BatchWriteItem", []byte(batchBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			UnprocessedItems map[string][]json.RawMessage
+		}
+		if err := json.Unmarshal(resp, &result); err != nil {
+			t.Fatal(err)
+		}
+		total += len(result.UnprocessedItems["people"])
+	}
+	if requester.items+total != 80 {
+		t.Errorf("Expected sent and unprocessed items to add up to 80, got %d + %d", requester.items, total)
+	}
+	if total == 0 || requester.items == 0 {
+		t.Errorf("Expected a mix of processed and unprocessed items, got %d + %d", requester.items, total)
+	}
+}
+
+// Answers every request with a body which isn't JSON.
+type garbledRequester struct{}
+
+func (garbledRequester) MakeRequest(target string, body []byte) ([]byte, error) {
+	return []byte("<html>"), nil
+}
+
+func TestUnprocessedGarbledResponse(t *testing.T) {
+	inj := &Injector{
+		Requester: garbledRequester{},
+		Seed:      1,
+		Rules:     []*Rule{{Target: "BatchWriteItem", Every: 1, Unprocessed: 0.5}},
+	}
+	if _, err := inj.MakeRequest("DynamoDB_20120810.BatchWriteItem", []byte(batchBody)); err == nil {
+		t.Errorf("Expected an error rather than losing the held back items")
+	}
+}
+
+func TestUnprocessedRepeatable(t *testing.T) {
+	var body bytes.Buffer
+	body.WriteString(`{"RequestItems":{`)
+	for i, table := range []string{"a", "b", "c", "d", "e", "f"} {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `%q:[{"PutRequest":{"Item":{"Id":{"N":"1"}}}},{"PutRequest":{"Item":{"Id":{"N":"2"}}}}]`, table)
+	}
+	body.WriteString("}}")
+
+	var first string
+	for i := 0; i < 5; i++ {
+		inj := &Injector{
+			Requester: &batchRequester{},
+			Seed:      7,
+			Rules:     []*Rule{{Target: "BatchWriteItem", Every: 1, Unprocessed: 0.5}},
+		}
+		resp, err := inj.MakeRequest("DynamoDB_20120810.BatchWriteItem", body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = string(resp)
+		} else if string(resp) != first {
+			t.Fatalf("Expected the same items held back each run, got %s and %s", first, resp)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+/*
+package hedge sends hedged requests to cut tail latency on reads.
+
+When a read has not been answered within the usual time, a Hedger sends a
+second copy of it and uses whichever answer comes back first. The "usual
+time" is a percentile of the latencies the Hedger has recently observed for
+that operation, so it adapts to the table rather than being hard-coded.
+
+Only GetItem, Query and BatchGetItem are ever hedged; everything else,
+and in particular every write, goes through exactly once.
+
+Usage:
+
+	h := &hedge.Hedger{Percentile: 0.9}
+	h.Install(executor)
+*/
+package hedge
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crast/dynatools/internal"
+	"github.com/crast/dynatools/middleware"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// The operations which are safe to hedge.
+var hedgeable = map[string]bool{
+	"GetItem":      true,
+	"Query":        true,
+	"BatchGetItem": true,
+}
+
+/*
+Hedger is an AwsRequester which hedges slow reads.
+
+All the settings are optional, and must not be changed once requests are
+flowing through the hedger.
+*/
+type Hedger struct {
+	Requester dynago.AwsRequester
+
+	// Send the hedge once a request is slower than this percentile (0 to 1)
+	// of recent latencies for the same operation.
+	Percentile float64 // Defaults to 0.95
+
+	Window     int           // How many recent latencies to remember per operation. Defaults to 1000
+	MinSamples int           // Don't hedge until this many latencies were seen. Defaults to 50
+	MinDelay   time.Duration // Never hedge sooner than this. Defaults to 2ms
+
+	mu        sync.Mutex
+	latencies map[string]*internal.LatencyWindow
+	hedged    int64
+	wins      int64
+}
+
+func (h *Hedger) MakeRequest(target string, body []byte) ([]byte, error) {
+	return h.makeRequest(context.Background(), h.Requester, target, body)
+}
+
+// MakeRequestContext is like MakeRequest, passing ctx on to the wrapped requester.
+func (h *Hedger) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return h.makeRequest(ctx, h.Requester, target, body)
+}
+
+// Hedged returns how many hedge requests have been sent.
+func (h *Hedger) Hedged() int64 {
+	return atomic.LoadInt64(&h.hedged)
+}
+
+// Wins returns how many times the hedge request answered first.
+func (h *Hedger) Wins() int64 {
+	return atomic.LoadInt64(&h.wins)
+}
+
+// Delay returns how long a request for the target waits before being hedged,
+// or zero if not enough latencies have been observed yet.
+func (h *Hedger) Delay(target string) time.Duration {
+	w := h.window(internal.Operation(target))
+	if w.Len() < h.minSamples() {
+		return 0
+	}
+	delay := w.Percentiles(h.percentile())[0]
+	if delay < h.minDelay() {
+		delay = h.minDelay()
+	}
+	return delay
+}
+
+// Middleware returns a layer which hedges reads using this Hedger's latencies.
+func (h *Hedger) Middleware() middleware.Middleware {
+	return func(next dynago.AwsRequester) dynago.AwsRequester {
+		return &layer{h, next}
+	}
+}
+
+// Install to the executor as the "hedge" layer of its middleware chain.
+func (h *Hedger) Install(executor *dynago.AwsExecutor) {
+	middleware.Install(executor).Use(Name, h.Middleware())
+}
+
+// The name Hedger uses for itself in a middleware chain.
+const Name = "hedge"
+
+type attempt struct {
+	response []byte
+	err      error
+	hedge    bool
+	latency  time.Duration
+}
+
+func (h *Hedger) makeRequest(ctx context.Context, requester dynago.AwsRequester, target string, body []byte) ([]byte, error) {
+	op := internal.Operation(target)
+	if !hedgeable[op] {
+		return internal.MakeRequest(ctx, requester, target, body)
+	}
+	delay := h.Delay(target)
+	if delay <= 0 {
+		start := time.Now()
+		response, err := internal.MakeRequest(ctx, requester, target, body)
+		if err == nil {
+			h.window(op).Add(time.Since(start))
+		}
+		return response, err
+	}
+
+	// Cancelling ctx abandons whichever request loses.
+	start := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan attempt, 2)
+	send := func(hedge bool) {
+		start := time.Now()
+		response, err := internal.MakeRequest(ctx, requester, target, body)
+		results <- attempt{response, err, hedge, time.Since(start)}
+	}
+	go send(false)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	hedged := false
+	var failed *attempt
+	for {
+		select {
+		case <-timer.C:
+			hedged = true
+			atomic.AddInt64(&h.hedged, 1)
+			go send(true)
+		case a := <-results:
+			if a.err == nil {
+				if a.hedge {
+					// Only the first request is sampled, so the latencies aren't
+					// skewed towards the faster of two tries. It is abandoned
+					// now, so this is a lower bound on how long it would take.
+					h.window(op).Add(time.Since(start))
+					atomic.AddInt64(&h.wins, 1)
+				} else {
+					h.window(op).Add(a.latency)
+				}
+				return a.response, nil
+			} else if failed != nil {
+				// Both failed, report the first error.
+				return failed.response, failed.err
+			} else if !hedged {
+				// Failing fast isn't slowness, so there's no point hedging.
+				return a.response, a.err
+			}
+			// Give the other request a chance to succeed.
+			failed = &a
+		}
+	}
+}
+
+func (h *Hedger) window(op string) *internal.LatencyWindow {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w := h.latencies[op]
+	if w == nil {
+		if h.latencies == nil {
+			h.latencies = make(map[string]*internal.LatencyWindow)
+		}
+		size := h.Window
+		if size <= 0 {
+			size = 1000
+		}
+		w = internal.NewLatencyWindow(size)
+		h.latencies[op] = w
+	}
+	return w
+}
+
+func (h *Hedger) percentile() float64 {
+	if h.Percentile > 0 && h.Percentile <= 1 {
+		return h.Percentile
+	}
+	return 0.95
+}
+
+func (h *Hedger) minSamples() int {
+	if h.MinSamples > 0 {
+		return h.MinSamples
+	}
+	return 50
+}
+
+func (h *Hedger) minDelay() time.Duration {
+	if h.MinDelay > 0 {
+		return h.MinDelay
+	}
+	return 2 * time.Millisecond
+}
+
+type layer struct {
+	hedger *Hedger
+	next   dynago.AwsRequester
+}
+
+func (l *layer) MakeRequest(target string, body []byte) ([]byte, error) {
+	return l.hedger.makeRequest(context.Background(), l.next, target, body)
+}
+
+func (l *layer) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return l.hedger.makeRequest(ctx, l.next, target, body)
+}
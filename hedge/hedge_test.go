@@ -0,0 +1,65 @@
+package hedge
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Answers after the given delays in turn, then instantly.
+type slowRequester struct {
+	calls  int32
+	delays []time.Duration
+}
+
+func (s *slowRequester) MakeRequest(target string, body []byte) ([]byte, error) {
+	n := int(atomic.AddInt32(&s.calls, 1))
+	if n <= len(s.delays) {
+		time.Sleep(s.delays[n-1])
+	}
+	return []byte("{}"), nil
+}
+
+func TestHedging(t *testing.T) {
+	requester := &slowRequester{}
+	h := &Hedger{Requester: requester, MinSamples: 10, MinDelay: 5 * time.Millisecond}
+
+	// Warm up the latencies
+	for i := 0; i < 10; i++ {
+		h.MakeRequest("DynamoDB_20120810.GetItem", nil)
+	}
+	if h.Delay("DynamoDB_20120810.GetItem") != 5*time.Millisecond {
+		t.Errorf("Expected hedge delay to be the minimum, got %v", h.Delay("DynamoDB_20120810.GetItem"))
+	}
+
+	atomic.StoreInt32(&requester.calls, 0)
+	requester.delays = []time.Duration{time.Second}
+	start := time.Now()
+	if _, err := h.MakeRequest("DynamoDB_20120810.GetItem", nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the hedge to answer quickly, took %v", elapsed)
+	}
+	if h.Hedged() != 1 || h.Wins() != 1 {
+		t.Errorf("Expected 1 hedge and 1 win, got %d and %d", h.Hedged(), h.Wins())
+	}
+	// The slow request counts for at least as long as it ran, not the hedge's time.
+	if slowest := h.window("GetItem").Percentiles(1)[0]; slowest < 5*time.Millisecond {
+		t.Errorf("Expected the abandoned request's latency to be sampled, slowest is %v", slowest)
+	}
+}
+
+func TestWritesNotHedged(t *testing.T) {
+	requester := &slowRequester{}
+	h := &Hedger{Requester: requester, MinSamples: 1}
+	for i := 0; i < 5; i++ {
+		h.MakeRequest("DynamoDB_20120810.PutItem", nil)
+	}
+	atomic.StoreInt32(&requester.calls, 0)
+	requester.delays = []time.Duration{20 * time.Millisecond}
+	h.MakeRequest("DynamoDB_20120810.PutItem", nil)
+	if calls := atomic.LoadInt32(&requester.calls); calls != 1 || h.Hedged() != 0 {
+		t.Errorf("Expected a single unhedged call, got %d calls and %d hedges", calls, h.Hedged())
+	}
+}
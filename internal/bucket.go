@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+TokenBucket limits a rate by reservation: a caller takes the tokens it needs
+straight away, going into debt if there aren't enough, and waits until the
+debt is paid off. Callers are admitted in the order they reserved.
+
+A rate of zero means unlimited.
+*/
+type TokenBucket struct {
+	// The clock, replaceable in tests. Defaults to time.Now.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	rate   float64 // Tokens per second
+	burst  float64 // The most tokens which can build up
+	tokens float64
+	last   time.Time
+}
+
+// Create a bucket holding tokens to start with.
+func NewTokenBucket(rate, burst, tokens float64) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: burst, tokens: tokens}
+}
+
+// Rate returns the tokens added per second.
+func (b *TokenBucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+/*
+SetRate changes the rate and burst, keeping the tokens earned at the old
+rate. A bucket which was unlimited starts off empty.
+*/
+func (b *TokenBucket) SetRate(rate, burst float64) {
+	b.mu.Lock()
+	b.refill(b.now())
+	if b.rate <= 0 {
+		b.tokens = 0
+	}
+	b.rate, b.burst = rate, burst
+	b.mu.Unlock()
+}
+
+// Reserve takes n tokens, returning how long to wait before using them.
+func (b *TokenBucket) Reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(b.now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Cancel gives back n reserved tokens which weren't used.
+func (b *TokenBucket) Cancel(n float64) {
+	b.mu.Lock()
+	b.tokens += n
+	b.mu.Unlock()
+}
+
+// Wait until n tokens may be used, or ctx is done.
+func (b *TokenBucket) Wait(ctx context.Context, n float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	wait := b.Reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.Cancel(n)
+		return ctx.Err()
+	}
+}
+
+// Add the tokens earned since the last refill. Must hold the lock.
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() && b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *TokenBucket) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A clock which only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	b := NewTokenBucket(10, 10, 1)
+	b.Now = clock.Now
+	if wait := b.Reserve(1); wait != 0 {
+		t.Errorf("Expected the starting token to be free, waited %v", wait)
+	}
+	if wait := b.Reserve(1); wait != 100*time.Millisecond {
+		t.Errorf("Expected to wait for one token at 10/s, waited %v", wait)
+	}
+	// A reservation queues up behind the ones before it.
+	if wait := b.Reserve(2); wait != 300*time.Millisecond {
+		t.Errorf("Expected to wait behind the debt, waited %v", wait)
+	}
+	b.Cancel(2)
+
+	// Tokens build up to the burst, and no further.
+	clock.now = clock.now.Add(time.Hour)
+	if wait := b.Reserve(10); wait != 0 {
+		t.Errorf("Expected a full bucket, waited %v", wait)
+	}
+	if wait := b.Reserve(5); wait != 500*time.Millisecond {
+		t.Errorf("Expected the burst to be capped at 10, waited %v", wait)
+	}
+
+	// Tokens earned at the old rate are kept when it changes.
+	clock.now = clock.now.Add(time.Second)
+	b.SetRate(100, 100)
+	if wait := b.Reserve(10); wait != 50*time.Millisecond {
+		t.Errorf("Expected 5 tokens left from the old rate, waited %v", wait)
+	}
+	if b.Rate() != 100 {
+		t.Errorf("Expected rate 100, got %v", b.Rate())
+	}
+
+	b.SetRate(0, 0)
+	if wait := b.Reserve(1000); wait != 0 {
+		t.Errorf("Expected no limit at rate 0, waited %v", wait)
+	}
+	b.SetRate(10, 10)
+	if wait := b.Reserve(1); wait != 100*time.Millisecond {
+		t.Errorf("Expected a bucket which was unlimited to start empty, waited %v", wait)
+	}
+}
+
+func TestTokenBucketWaitCancelled(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	b := NewTokenBucket(1, 1, 0)
+	b.Now = clock.Now
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Wait(ctx, 1); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx, 10); err != context.DeadlineExceeded {
+		t.Errorf("Expected the wait to be cut short, got %v", err)
+	}
+	// The cancelled reservation was given back.
+	if wait := b.Reserve(1); wait != time.Second {
+		t.Errorf("Expected only the new reservation to count, waited %v", wait)
+	}
+}
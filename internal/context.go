@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// ContextRequester is implemented by requesters which can be cancelled.
+type ContextRequester interface {
+	MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error)
+}
+
+type response struct {
+	body []byte
+	err  error
+}
+
+/*
+MakeRequest runs a request on r, returning early if ctx is done first.
+
+Requesters which implement ContextRequester are handed the context directly.
+For all others the request runs in its own goroutine, and the result is
+thrown away if it arrives after the context has ended.
+*/
+func MakeRequest(ctx context.Context, r dynago.AwsRequester, target string, body []byte) ([]byte, error) {
+	if cr, ok := r.(ContextRequester); ok {
+		return cr.MakeRequestContext(ctx, target, body)
+	}
+	if ctx.Done() == nil {
+		return r.MakeRequest(target, body)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ch := make(chan response, 1)
+	go func() {
+		body, err := r.MakeRequest(target, body)
+		ch <- response{body, err}
+	}()
+	select {
+	case resp := <-ch:
+		return resp.body, resp.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type attemptKey struct{}
+
+// WithAttempt records which try of a request this is, starting from 1.
+func WithAttempt(ctx context.Context, attempt uint) context.Context {
+	return context.WithValue(ctx, attemptKey{}, attempt)
+}
+
+// AttemptFrom returns the try recorded by WithAttempt, or 0 if there isn't one.
+func AttemptFrom(ctx context.Context) uint {
+	attempt, _ := ctx.Value(attemptKey{}).(uint)
+	return attempt
+}
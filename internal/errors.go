@@ -1,11 +1,125 @@
 package internal
 
-import "gopkg.in/underarmour/dynago.v0"
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
 
-// Assert an error as a dynago error
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+/*
+AssertError finds the dynago error in err's chain, if there is one.
+
+Errors wrapped with fmt.Errorf("%w") or anything else with an Unwrap method
+are looked through.
+*/
 func AssertError(err error) *dynago.Error {
-	if e, ok := err.(*dynago.Error); ok {
+	var e *dynago.Error
+	if errors.As(err, &e) {
 		return e
 	}
 	return nil
 }
+
+// Whether err is a dynago error of one of the given types.
+func isType(err error, types ...dynago.AmazonError) bool {
+	if e := AssertError(err); e != nil {
+		for _, t := range types {
+			if e.Type == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsThrottle reports whether err is DynamoDB pushing back on request rate.
+func IsThrottle(err error) bool {
+	return isType(err, dynago.ErrorThroughputExceeded, dynago.ErrorThrottling)
+}
+
+// IsConditionFailed reports whether err is a failed condition expression.
+func IsConditionFailed(err error) bool {
+	return isType(err, dynago.ErrorConditionFailed)
+}
+
+// IsNotFound reports whether err is a missing table or other resource.
+func IsNotFound(err error) bool {
+	return isType(err, dynago.ErrorNotFound)
+}
+
+// IsServiceError reports whether err is DynamoDB failing on its side.
+func IsServiceError(err error) bool {
+	return isType(err, dynago.ErrorServiceUnavailable, dynago.ErrorInternalFailure)
+}
+
+/*
+IsRetryable reports whether the request which failed with err is worth
+trying again: throttling, DynamoDB service errors, and transient transport
+errors as recognized by IsTransient.
+*/
+func IsRetryable(err error) bool {
+	if e := AssertError(err); e != nil {
+		return IsThrottle(e) || IsServiceError(e)
+	}
+	return IsTransient(err)
+}
+
+// Low-level connection errors which are worth trying again.
+var transientErrnos = []error{
+	syscall.ECONNRESET,
+	syscall.ECONNREFUSED,
+	syscall.ECONNABORTED,
+	syscall.EPIPE,
+	syscall.ETIMEDOUT,
+}
+
+/*
+IsTransient reports whether err is a transport error which may well succeed
+if the request is tried again.
+
+This covers network timeouts, connection resets and refusals, connections
+closed mid-response (EOF) and broken TLS handshakes. Errors wrapped by
+*url.Error or *net.OpError are unwrapped.
+*/
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var headerErr tls.RecordHeaderError
+	if errors.As(err, &headerErr) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return false
+}
+
+/*
+ErrorType describes the kind of an error: Amazon's name for the error when
+it's a dynago error, otherwise the Go type of the error.
+*/
+func ErrorType(err error) string {
+	if e := AssertError(err); e != nil && e.AmazonRawType != "" {
+		return e.AmazonRawType
+	}
+	return fmt.Sprintf("%T", err)
+}
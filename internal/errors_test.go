@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+func TestPredicates(t *testing.T) {
+	throttle := &dynago.Error{Type: dynago.ErrorThroughputExceeded}
+	condition := &dynago.Error{Type: dynago.ErrorConditionFailed}
+	notFound := &dynago.Error{Type: dynago.ErrorNotFound}
+	internalErr := &dynago.Error{Type: dynago.ErrorInternalFailure}
+
+	cases := []struct {
+		err                                              error
+		retryable, throttle, condition, missing, service bool
+	}{
+		{nil, false, false, false, false, false},
+		{throttle, true, true, false, false, false},
+		{fmt.Errorf("writing: %w", throttle), true, true, false, false, false},
+		{&dynago.Error{Type: dynago.ErrorThrottling}, true, true, false, false, false},
+		{internalErr, true, false, false, false, true},
+		{&dynago.Error{Type: dynago.ErrorServiceUnavailable}, true, false, false, false, true},
+		{condition, false, false, true, false, false},
+		{fmt.Errorf("a: %w", fmt.Errorf("b: %w", condition)), false, false, true, false, false},
+		{notFound, false, false, false, true, false},
+		{io.ErrUnexpectedEOF, true, false, false, false, false},
+		{errors.New("something else"), false, false, false, false, false},
+	}
+	for _, c := range cases {
+		if IsRetryable(c.err) != c.retryable {
+			t.Errorf("IsRetryable(%v) should be %v", c.err, c.retryable)
+		}
+		if IsThrottle(c.err) != c.throttle {
+			t.Errorf("IsThrottle(%v) should be %v", c.err, c.throttle)
+		}
+		if IsConditionFailed(c.err) != c.condition {
+			t.Errorf("IsConditionFailed(%v) should be %v", c.err, c.condition)
+		}
+		if IsNotFound(c.err) != c.missing {
+			t.Errorf("IsNotFound(%v) should be %v", c.err, c.missing)
+		}
+		if IsServiceError(c.err) != c.service {
+			t.Errorf("IsServiceError(%v) should be %v", c.err, c.service)
+		}
+	}
+}
+
+func TestAssertErrorWrapped(t *testing.T) {
+	e := &dynago.Error{Type: dynago.ErrorConditionFailed, AmazonRawType: "ConditionalCheckFailedException"}
+	if AssertError(fmt.Errorf("wrapped: %w", e)) != e {
+		t.Errorf("Expected to find the wrapped dynago error")
+	}
+	if AssertError(errors.New("x")) != nil {
+		t.Errorf("Expected nil for a plain error")
+	}
+	if s := ErrorType(fmt.Errorf("wrapped: %w", e)); s != "ConditionalCheckFailedException" {
+		t.Errorf("Unexpected error type %q", s)
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyWindow remembers the most recent latencies, for estimating percentiles.
+type LatencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// Create a window holding up to size samples.
+func NewLatencyWindow(size int) *LatencyWindow {
+	return &LatencyWindow{samples: make([]time.Duration, size)}
+}
+
+// Add a sample, pushing out the oldest one if the window is full.
+func (w *LatencyWindow) Add(d time.Duration) {
+	w.mu.Lock()
+	w.samples[w.next] = d
+	w.next++
+	if w.next == len(w.samples) {
+		w.next = 0
+		w.full = true
+	}
+	w.mu.Unlock()
+}
+
+// Len returns how many samples are in the window.
+func (w *LatencyWindow) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.full {
+		return len(w.samples)
+	}
+	return w.next
+}
+
+/*
+Percentiles returns the latency at each of the percentiles given (from 0 to
+1) using the nearest-rank method. All the results are zero if the window is
+empty.
+*/
+func (w *LatencyWindow) Percentiles(ps ...float64) []time.Duration {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	results := make([]time.Duration, len(ps))
+	if n == 0 {
+		return results
+	}
+	for i, p := range ps {
+		rank := int(p*float64(n)+0.5) - 1
+		if rank < 0 {
+			rank = 0
+		} else if rank >= n {
+			rank = n - 1
+		}
+		results[i] = sorted[rank]
+	}
+	return results
+}
@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	w := NewLatencyWindow(100)
+	if p := w.Percentiles(0.5)[0]; p != 0 {
+		t.Errorf("Expected 0 for empty window, got %v", p)
+	}
+	// Fill with 1ms..150ms so the first 50 samples get pushed out
+	for i := 1; i <= 150; i++ {
+		w.Add(time.Duration(i) * time.Millisecond)
+	}
+	if w.Len() != 100 {
+		t.Errorf("Expected 100 samples, got %d", w.Len())
+	}
+	expected := []time.Duration{51 * time.Millisecond, 100 * time.Millisecond, 145 * time.Millisecond, 150 * time.Millisecond}
+	for i, p := range w.Percentiles(0, 0.5, 0.95, 1) {
+		if p != expected[i] {
+			t.Errorf("Percentile %d: Expected %v, got %v", i, expected[i], p)
+		}
+	}
+}
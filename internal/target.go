@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+/*
+Operation returns the DynamoDB operation named by a target header.
+
+For example "DynamoDB_20120810.GetItem" gives "GetItem". Targets without a
+version prefix are returned unchanged.
+*/
+func Operation(target string) string {
+	if i := strings.LastIndex(target, "."); i >= 0 {
+		return target[i+1:]
+	}
+	return target
+}
+
+/*
+TableNames returns the tables a request body refers to.
+
+Most operations name a single table in TableName, while the batch operations
+have a table name for each key of RequestItems.
+*/
+func TableNames(body []byte) []string {
+	var req struct {
+		TableName    string
+		RequestItems map[string]json.RawMessage
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return nil
+	}
+	if req.TableName != "" {
+		return []string{req.TableName}
+	}
+	names := make([]string, 0, len(req.RequestItems))
+	for name := range req.RequestItems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
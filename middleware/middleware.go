@@ -0,0 +1,183 @@
+/*
+package middleware stacks requester layers onto a dynago executor.
+
+A layer is just a function which wraps one AwsRequester in another, such as
+retries, circuit breaking, logging or metrics. A Chain keeps track of the
+layers installed on an executor by name, so the same layer is never installed
+twice, and any layer can be removed again later.
+
+Layers run in the order they were added: the first layer added sees each
+request first, and the last layer added is the closest to the network.
+
+Usage:
+
+	chain := middleware.Install(executor)
+	chain.Use("breaker", myBreaker.Middleware())
+	chain.Use("autoretry", myRetry.Middleware())
+	client := dynago.NewClient(executor)
+*/
+package middleware
+
+import (
+	"context"
+	"sync"
+
+	"github.com/crast/dynatools/internal"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// Middleware wraps a requester to add behaviour around every request.
+type Middleware func(next dynago.AwsRequester) dynago.AwsRequester
+
+// RequesterFunc adapts an ordinary function into an AwsRequester.
+type RequesterFunc func(target string, body []byte) ([]byte, error)
+
+func (f RequesterFunc) MakeRequest(target string, body []byte) ([]byte, error) {
+	return f(target, body)
+}
+
+/*
+Chain is an ordered stack of named layers installed on an executor.
+
+It is safe to add and remove layers while requests are in flight; requests
+which already started finish on the layers they started with.
+*/
+type Chain struct {
+	mu     sync.Mutex
+	exec   *dynago.AwsExecutor
+	head   *head
+	base   dynago.AwsRequester
+	layers []layer
+}
+
+type layer struct {
+	name string
+	wrap Middleware
+}
+
+/*
+Install a chain on the executor, or return the chain already installed on it.
+
+The executor's current requester becomes the innermost requester of the
+chain, which initially has no layers at all.
+*/
+func Install(executor *dynago.AwsExecutor) *Chain {
+	if h, ok := executor.Requester.(*head); ok {
+		return h.chain
+	}
+	c := &Chain{
+		exec: executor,
+		base: executor.Requester,
+	}
+	c.head = &head{chain: c, next: c.base}
+	executor.Requester = c.head
+	return c
+}
+
+/*
+Add a layer on the inside of all the existing layers.
+
+If a layer with this name is already installed, nothing is changed and
+Use returns false.
+*/
+func (c *Chain) Use(name string, m Middleware) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.index(name) >= 0 {
+		return false
+	}
+	c.layers = append(c.layers, layer{name, m})
+	c.rebuild()
+	return true
+}
+
+// Remove the named layer, returning false if it wasn't installed.
+func (c *Chain) Remove(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.index(name)
+	if i < 0 {
+		return false
+	}
+	c.layers = append(c.layers[:i:i], c.layers[i+1:]...)
+	c.rebuild()
+	return true
+}
+
+// Has reports whether a layer with this name is installed.
+func (c *Chain) Has(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.index(name) >= 0
+}
+
+// Names of all the installed layers, outermost first.
+func (c *Chain) Names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, len(c.layers))
+	for i, l := range c.layers {
+		names[i] = l.name
+	}
+	return names
+}
+
+/*
+Uninstall removes every layer and puts the executor's original requester
+back in place. The chain must not be used after this.
+*/
+func (c *Chain) Uninstall() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.layers = nil
+	c.rebuild()
+	if c.exec.Requester == dynago.AwsRequester(c.head) {
+		c.exec.Requester = c.base
+	}
+}
+
+// Must hold the lock.
+func (c *Chain) index(name string) int {
+	for i, l := range c.layers {
+		if l.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Must hold the lock.
+func (c *Chain) rebuild() {
+	requester := c.base
+	for i := len(c.layers) - 1; i >= 0; i-- {
+		requester = c.layers[i].wrap(requester)
+	}
+	c.head.set(requester)
+}
+
+// head is what actually gets installed as the executor's requester.
+type head struct {
+	chain *Chain
+	mu    sync.RWMutex
+	next  dynago.AwsRequester
+}
+
+func (h *head) set(next dynago.AwsRequester) {
+	h.mu.Lock()
+	h.next = next
+	h.mu.Unlock()
+}
+
+func (h *head) get() dynago.AwsRequester {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.next
+}
+
+func (h *head) MakeRequest(target string, body []byte) ([]byte, error) {
+	return h.get().MakeRequest(target, body)
+}
+
+func (h *head) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return internal.MakeRequest(ctx, h.get(), target, body)
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// A layer which records its name into the request trail.
+func tag(name string, trail *[]string) Middleware {
+	return func(next dynago.AwsRequester) dynago.AwsRequester {
+		return RequesterFunc(func(target string, body []byte) ([]byte, error) {
+			*trail = append(*trail, name)
+			return next.MakeRequest(target, body)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var trail []string
+	base := RequesterFunc(func(target string, body []byte) ([]byte, error) {
+		trail = append(trail, "base")
+		return nil, nil
+	})
+	executor := &dynago.AwsExecutor{Requester: base}
+	check := func(expected string) {
+		trail = nil
+		executor.Requester.MakeRequest("DynamoDB_20120810.GetItem", nil)
+		if result := strings.Join(trail, ","); result != expected {
+			t.Errorf("Expected %s, got %s", expected, result)
+		}
+	}
+
+	chain := Install(executor)
+	if Install(executor) != chain {
+		t.Errorf("Installing twice should give back the same chain")
+	}
+	chain.Use("a", tag("a", &trail))
+	chain.Use("b", tag("b", &trail))
+	if chain.Use("a", tag("a", &trail)) {
+		t.Errorf("Expected duplicate layer to be refused")
+	}
+	check("a,b,base")
+
+	chain.Remove("a")
+	chain.Use("c", tag("c", &trail))
+	check("b,c,base")
+	if names := strings.Join(chain.Names(), ","); names != "b,c" {
+		t.Errorf("Expected names b,c, got %s", names)
+	}
+
+	chain.Uninstall()
+	if _, ok := executor.Requester.(RequesterFunc); !ok {
+		t.Errorf("Expected original requester to be restored")
+	}
+	check("base")
+}
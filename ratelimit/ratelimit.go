@@ -0,0 +1,219 @@
+/*
+package ratelimit is an adaptive client-side rate limiter for DynamoDB.
+
+A Limiter learns how fast each table can be used by watching for throughput
+errors, using additive-increase/multiplicative-decrease: every throughput
+exceeded error cuts the table's request rate by a factor, and every run of
+successful requests raises it by a fixed amount.
+
+One Limiter is meant to be shared by everything that talks to the same
+tables, such as all the workers of a bulk.BulkWriter as well as any ad-hoc
+clients, so they stop fighting each other for the same provisioned capacity.
+
+Usage:
+
+	limiter := &ratelimit.Limiter{Initial: 50}
+	limiter.Install(bulkExecutor)
+	limiter.Install(appExecutor)
+*/
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/crast/dynatools/internal"
+	"github.com/crast/dynatools/middleware"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+/*
+Limiter limits the request rate to each table.
+
+All the settings are optional, and must not be changed once requests are
+flowing through the limiter.
+*/
+type Limiter struct {
+	Initial    float64 // Requests per second each table starts at. Defaults to 100
+	Min        float64 // Never go slower than this. Defaults to 1
+	Max        float64 // Never go faster than this. Defaults to 10000
+	Increase   float64 // Requests per second added after a run of successes. Defaults to Initial/10
+	Decrease   float64 // Factor the rate is multiplied by on throttling. Defaults to 0.5
+	SuccessRun int     // How many successes in a row before increasing. Defaults to 10
+
+	// Only cut the rate once per this long, as a burst of throttling errors
+	// usually comes from requests that were all sent at the old rate.
+	Cooldown time.Duration // Defaults to 1 second
+
+	mu     sync.Mutex
+	tables map[string]*tableState
+}
+
+type tableState struct {
+	bucket    *internal.TokenBucket
+	successes int
+	cutAt     time.Time
+}
+
+// Rate returns the current requests per second allowed for a table.
+func (l *Limiter) Rate(table string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.table(table).bucket.Rate()
+}
+
+/*
+Wait blocks until a request to the table is allowed, or ctx is done.
+
+Requests are admitted in the order Wait was called.
+*/
+func (l *Limiter) Wait(ctx context.Context, table string) error {
+	l.mu.Lock()
+	t := l.table(table)
+	l.mu.Unlock()
+	return t.bucket.Wait(ctx, 1)
+}
+
+// Record the outcome of a request to a table, adjusting its rate.
+func (l *Limiter) Record(table string, err error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.table(table)
+	if err == nil {
+		t.successes++
+		if t.successes >= l.successRun() {
+			t.successes = 0
+			t.setRate(t.bucket.Rate()+l.increase(), l)
+		}
+	} else if e := internal.AssertError(err); e != nil && e.Type == dynago.ErrorThroughputExceeded {
+		t.successes = 0
+		if now.Sub(t.cutAt) >= l.cooldown() {
+			t.cutAt = now
+			t.setRate(t.bucket.Rate()*l.decrease(), l)
+		}
+	}
+}
+
+// Middleware returns a layer which rate limits requests using this Limiter.
+func (l *Limiter) Middleware() middleware.Middleware {
+	return func(next dynago.AwsRequester) dynago.AwsRequester {
+		return &layer{l, next}
+	}
+}
+
+// Install to the executor as the "ratelimit" layer of its middleware chain.
+func (l *Limiter) Install(executor *dynago.AwsExecutor) {
+	middleware.Install(executor).Use(Name, l.Middleware())
+}
+
+// The name Limiter uses for itself in a middleware chain.
+const Name = "ratelimit"
+
+func (l *Limiter) makeRequest(ctx context.Context, requester dynago.AwsRequester, target string, body []byte) ([]byte, error) {
+	tables := internal.TableNames(body)
+	for _, table := range tables {
+		if err := l.Wait(ctx, table); err != nil {
+			return nil, err
+		}
+	}
+	response, err := internal.MakeRequest(ctx, requester, target, body)
+	for _, table := range tables {
+		l.Record(table, err)
+	}
+	return response, err
+}
+
+// Must hold the lock.
+func (l *Limiter) table(name string) *tableState {
+	t := l.tables[name]
+	if t == nil {
+		if l.tables == nil {
+			l.tables = make(map[string]*tableState)
+		}
+		rate := l.initial()
+		t = &tableState{bucket: internal.NewTokenBucket(rate, burst(rate), 1)}
+		l.tables[name] = t
+	}
+	return t
+}
+
+// Allow up to a second's burst, and at least one request.
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+func (t *tableState) setRate(rate float64, l *Limiter) {
+	if rate < l.min() {
+		rate = l.min()
+	} else if rate > l.max() {
+		rate = l.max()
+	}
+	t.bucket.SetRate(rate, burst(rate))
+}
+
+func (l *Limiter) initial() float64 {
+	if l.Initial > 0 {
+		return l.Initial
+	}
+	return 100
+}
+
+func (l *Limiter) min() float64 {
+	if l.Min > 0 {
+		return l.Min
+	}
+	return 1
+}
+
+func (l *Limiter) max() float64 {
+	if l.Max > 0 {
+		return l.Max
+	}
+	return 10000
+}
+
+func (l *Limiter) increase() float64 {
+	if l.Increase > 0 {
+		return l.Increase
+	}
+	return l.initial() / 10
+}
+
+func (l *Limiter) decrease() float64 {
+	if l.Decrease > 0 && l.Decrease < 1 {
+		return l.Decrease
+	}
+	return 0.5
+}
+
+func (l *Limiter) successRun() int {
+	if l.SuccessRun > 0 {
+		return l.SuccessRun
+	}
+	return 10
+}
+
+func (l *Limiter) cooldown() time.Duration {
+	if l.Cooldown > 0 {
+		return l.Cooldown
+	}
+	return time.Second
+}
+
+type layer struct {
+	limiter *Limiter
+	next    dynago.AwsRequester
+}
+
+func (l *layer) MakeRequest(target string, body []byte) ([]byte, error) {
+	return l.limiter.makeRequest(context.Background(), l.next, target, body)
+}
+
+func (l *layer) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return l.limiter.makeRequest(ctx, l.next, target, body)
+}
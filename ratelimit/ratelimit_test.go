@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+var throughputErr = &dynago.Error{Type: dynago.ErrorThroughputExceeded}
+
+func TestAIMD(t *testing.T) {
+	l := &Limiter{Initial: 100, Increase: 10, SuccessRun: 5, Min: 10, Cooldown: time.Nanosecond}
+	l.Record("people", throughputErr)
+	if rate := l.Rate("people"); rate != 50 {
+		t.Errorf("Expected rate 50, got %v", rate)
+	}
+	for i := 0; i < 10; i++ {
+		l.Record("people", nil)
+	}
+	if rate := l.Rate("people"); rate != 70 {
+		t.Errorf("Expected rate 70, got %v", rate)
+	}
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Microsecond)
+		l.Record("people", throughputErr)
+	}
+	if rate := l.Rate("people"); rate != 10 {
+		t.Errorf("Expected rate to bottom out at 10, got %v", rate)
+	}
+	if rate := l.Rate("other"); rate != 100 {
+		t.Errorf("Expected other table to be unaffected, got %v", rate)
+	}
+}
+
+func TestOnlyThroughputCuts(t *testing.T) {
+	l := &Limiter{Initial: 100, Cooldown: time.Nanosecond}
+	l.Record("people", &dynago.Error{Type: dynago.ErrorThrottling})
+	l.Record("people", &dynago.Error{Type: dynago.ErrorInternalFailure})
+	if rate := l.Rate("people"); rate != 100 {
+		t.Errorf("Expected other errors to leave the rate alone, got %v", rate)
+	}
+	l.Record("people", fmt.Errorf("query: %w", throughputErr))
+	if rate := l.Rate("people"); rate != 50 {
+		t.Errorf("Expected a wrapped throughput error to cut the rate, got %v", rate)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	l := &Limiter{Initial: 100}
+	for i := 0; i < 5; i++ {
+		l.Record("people", throughputErr)
+	}
+	if rate := l.Rate("people"); rate != 50 {
+		t.Errorf("Expected a single cut to 50, got %v", rate)
+	}
+}
+
+func TestWait(t *testing.T) {
+	l := &Limiter{Initial: 100}
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if err := l.Wait(context.Background(), "people"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected 11 requests at 100/s to take about 100ms, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(ctx, "people"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// Matcher decides whether a recorded request body matches an actual one.
+type Matcher func(recorded, actual []byte) bool
+
+// Exact matches only byte-for-byte identical bodies.
+func Exact(recorded, actual []byte) bool {
+	return bytes.Equal(recorded, actual)
+}
+
+/*
+NormalizedJSON matches bodies which decode to the same JSON value, ignoring
+whitespace and the order of object keys.
+*/
+func NormalizedJSON(recorded, actual []byte) bool {
+	return matchJSON(recorded, actual, nil)
+}
+
+/*
+IgnoreFields matches like NormalizedJSON, but ignores object keys with the
+given names at any depth.
+
+This is handy for fields that change from run to run, like an
+ExclusiveStartKey or a timestamp in an ExpressionAttributeValues.
+*/
+func IgnoreFields(fields ...string) Matcher {
+	ignore := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		ignore[f] = true
+	}
+	return func(recorded, actual []byte) bool {
+		return matchJSON(recorded, actual, ignore)
+	}
+}
+
+func matchJSON(recorded, actual []byte, ignore map[string]bool) bool {
+	var a, b interface{}
+	if json.Unmarshal(recorded, &a) != nil || json.Unmarshal(actual, &b) != nil {
+		return bytes.Equal(recorded, actual)
+	}
+	return reflect.DeepEqual(strip(a, ignore), strip(b, ignore))
+}
+
+// Remove ignored keys from a decoded JSON value.
+func strip(v interface{}, ignore map[string]bool) interface{} {
+	if len(ignore) == 0 {
+		return v
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range v {
+			if ignore[k] {
+				delete(v, k)
+			} else {
+				v[k] = strip(inner, ignore)
+			}
+		}
+	case []interface{}:
+		for i, inner := range v {
+			v[i] = strip(inner, ignore)
+		}
+	}
+	return v
+}
@@ -0,0 +1,239 @@
+/*
+package replay records DynamoDB traffic to disk and plays it back in tests.
+
+A Recorder wraps a real requester and remembers every request and response
+that passes through it, saving them to a cassette file. A Replayer reads the
+cassette back and answers the same requests without touching the network,
+which makes it possible to test code like bulk or streamer against real
+recorded payloads.
+
+Recording:
+
+	recorder := replay.NewRecorder("testdata/people.json", executor.Requester)
+	executor.Requester = recorder
+	// ... run the code under test against a real table ...
+	recorder.Save()
+
+Replaying:
+
+	replayer, err := replay.NewReplayer("testdata/people.json", replay.IgnoreFields("ExclusiveStartKey"))
+	executor := &dynago.AwsExecutor{Requester: replayer}
+*/
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/crast/dynatools/internal"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+// Cassette is the on-disk format of a recording.
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction is a single recorded request and its outcome.
+type Interaction struct {
+	Target   string          `json:"target"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    *RecordedError  `json:"error,omitempty"`
+}
+
+/*
+RecordedError is an error as stored in a cassette.
+
+Errors which were a *dynago.Error are replayed as a *dynago.Error with the
+same type and message, any others are replayed as a plain error.
+*/
+type RecordedError struct {
+	Dynago  bool               `json:"dynago"`
+	Type    dynago.AmazonError `json:"type,omitempty"`
+	RawType string             `json:"rawType,omitempty"`
+	Message string             `json:"message"`
+}
+
+func recordError(err error) *RecordedError {
+	if err == nil {
+		return nil
+	} else if e := internal.AssertError(err); e != nil {
+		return &RecordedError{Dynago: true, Type: e.Type, RawType: e.AmazonRawType, Message: e.Message}
+	}
+	return &RecordedError{Message: err.Error()}
+}
+
+func (e *RecordedError) err() error {
+	if e == nil {
+		return nil
+	} else if e.Dynago {
+		return &dynago.Error{Type: e.Type, AmazonRawType: e.RawType, Message: e.Message}
+	}
+	return &ReplayedError{e.Message}
+}
+
+// ReplayedError stands in for a recorded error which was not a dynago error.
+type ReplayedError struct {
+	Message string
+}
+
+func (e *ReplayedError) Error() string {
+	return e.Message
+}
+
+// Load a cassette from a file.
+func Load(path string) (*Cassette, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, fmt.Errorf("replay: decoding %s: %v", path, err)
+	}
+	for _, interaction := range c.Interactions {
+		interaction.Request = compact(interaction.Request)
+		interaction.Response = compact(interaction.Response)
+	}
+	return c, nil
+}
+
+// Save the cassette to a file, replacing anything already there.
+func (c *Cassette) Save(path string) error {
+	buf, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf, 0644)
+}
+
+// Recorder is an AwsRequester which remembers all the traffic through it.
+type Recorder struct {
+	Requester dynago.AwsRequester
+	path      string
+	mu        sync.Mutex
+	cassette  Cassette
+}
+
+// Create a recorder which passes requests on to requester, and saves to path.
+func NewRecorder(path string, requester dynago.AwsRequester) *Recorder {
+	return &Recorder{
+		Requester: requester,
+		path:      path,
+	}
+}
+
+func (r *Recorder) MakeRequest(target string, body []byte) ([]byte, error) {
+	response, err := r.Requester.MakeRequest(target, body)
+	interaction := &Interaction{
+		Target:  target,
+		Request: json.RawMessage(body),
+		Error:   recordError(err),
+	}
+	if len(response) > 0 {
+		interaction.Response = json.RawMessage(response)
+	}
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+	r.mu.Unlock()
+	return response, err
+}
+
+// Save everything recorded so far to the cassette file.
+func (r *Recorder) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cassette.Save(r.path)
+}
+
+/*
+Replayer is an AwsRequester which answers requests from a cassette.
+
+Each recorded interaction is used at most once, in the order they were
+recorded, so a sequence of identical requests (such as paging through a
+Query) gets the sequence of recorded responses.
+*/
+type Replayer struct {
+	match    Matcher
+	mu       sync.Mutex
+	cassette *Cassette
+	used     []bool
+}
+
+// Create a replayer from a cassette file. A nil matcher means NormalizedJSON.
+func NewReplayer(path string, matcher Matcher) (*Replayer, error) {
+	cassette, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewCassetteReplayer(cassette, matcher), nil
+}
+
+// Create a replayer from a cassette already in memory.
+func NewCassetteReplayer(cassette *Cassette, matcher Matcher) *Replayer {
+	if matcher == nil {
+		matcher = NormalizedJSON
+	}
+	return &Replayer{
+		match:    matcher,
+		cassette: cassette,
+		used:     make([]bool, len(cassette.Interactions)),
+	}
+}
+
+func (r *Replayer) MakeRequest(target string, body []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, interaction := range r.cassette.Interactions {
+		if r.used[i] || interaction.Target != target {
+			continue
+		}
+		if r.match(interaction.Request, body) {
+			r.used[i] = true
+			return []byte(interaction.Response), interaction.Error.err()
+		}
+	}
+	return nil, &NoMatchError{Target: target, Body: body}
+}
+
+// Unused returns the interactions which have not been replayed yet.
+func (r *Replayer) Unused() []*Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []*Interaction
+	for i, interaction := range r.cassette.Interactions {
+		if !r.used[i] {
+			unused = append(unused, interaction)
+		}
+	}
+	return unused
+}
+
+/*
+Undo the indenting done when saving the cassette, so bodies are replayed and
+matched as they were recorded.
+*/
+func compact(msg json.RawMessage) json.RawMessage {
+	if len(msg) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if json.Compact(&buf, msg) != nil {
+		return msg
+	}
+	return buf.Bytes()
+}
+
+// NoMatchError is returned when a request has no recorded interaction.
+type NoMatchError struct {
+	Target string
+	Body   []byte
+}
+
+func (e *NoMatchError) Error() string {
+	return fmt.Sprintf("replay: no recorded interaction for %s %s", internal.Operation(e.Target), e.Body)
+}
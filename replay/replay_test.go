@@ -0,0 +1,89 @@
+package replay
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+type fakeRequester struct {
+	calls int
+}
+
+func (f *fakeRequester) MakeRequest(target string, body []byte) ([]byte, error) {
+	f.calls++
+	if f.calls == 3 {
+		return nil, &dynago.Error{Type: dynago.ErrorThroughputExceeded, Message: "slow down"}
+	}
+	return []byte(`{"Count":1}`), nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recorder := NewRecorder(path, &fakeRequester{})
+	recorder.MakeRequest("DynamoDB_20120810.Query", []byte(`{"TableName":"people","ExclusiveStartKey":{"Id":{"N":"1"}}}`))
+	recorder.MakeRequest("DynamoDB_20120810.Query", []byte(`{"TableName":"people","ExclusiveStartKey":{"Id":{"N":"2"}}}`))
+	recorder.MakeRequest("DynamoDB_20120810.GetItem", []byte(`{"TableName":"people"}`))
+	if err := recorder.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := NewReplayer(path, IgnoreFields("ExclusiveStartKey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := replayer.MakeRequest("DynamoDB_20120810.Query", []byte(`{ "ExclusiveStartKey": {"Id": {"N": "9"}}, "TableName": "people" }`))
+		if err != nil || string(resp) != `{"Count":1}` {
+			t.Errorf("Query %d: unexpected response %s, %v", i, resp, err)
+		}
+	}
+	if _, err := replayer.MakeRequest("DynamoDB_20120810.Query", []byte(`{"TableName":"people"}`)); err == nil {
+		t.Errorf("Expected a NoMatchError after the recorded queries were used up")
+	}
+
+	_, err = replayer.MakeRequest("DynamoDB_20120810.GetItem", []byte(`{"TableName": "people"}`))
+	if e, ok := err.(*dynago.Error); !ok || e.Type != dynago.ErrorThroughputExceeded || e.Message != "slow down" {
+		t.Errorf("Expected replayed throughput error, got %v", err)
+	}
+	if len(replayer.Unused()) != 0 {
+		t.Errorf("Expected every interaction to be used")
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	a := []byte(`{"TableName":"people","Key":{"Id":{"N":"1"}}}`)
+	b := []byte(`{"Key": {"Id": {"N": "1"}}, "TableName": "people"}`)
+	if Exact(a, b) {
+		t.Errorf("Exact should not match reordered bodies")
+	}
+	if !NormalizedJSON(a, b) {
+		t.Errorf("NormalizedJSON should match reordered bodies")
+	}
+	if NormalizedJSON(a, []byte(`{"TableName":"people"}`)) {
+		t.Errorf("NormalizedJSON should not match different bodies")
+	}
+	if !IgnoreFields("Key")(a, []byte(`{"TableName":"people"}`)) {
+		t.Errorf("IgnoreFields should ignore the Key")
+	}
+}
+
+func TestReplayExactAfterSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	body := []byte(`{"TableName":"people","Key":{"Id":{"N":"1"}}}`)
+	recorder := NewRecorder(path, &fakeRequester{})
+	recorder.MakeRequest("DynamoDB_20120810.GetItem", body)
+	if err := recorder.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := NewReplayer(path, Exact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := replayer.MakeRequest("DynamoDB_20120810.GetItem", body)
+	if err != nil || string(resp) != `{"Count":1}` {
+		t.Errorf("Expected the saved request to match exactly, got %s, %v", resp, err)
+	}
+}
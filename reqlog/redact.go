@@ -0,0 +1,142 @@
+package reqlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// Replaces the value of every redacted attribute.
+const redacted = "REDACTED"
+
+type redactor struct {
+	names    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+func (l *RequestLogger) redactor() *redactor {
+	r := &redactor{names: make(map[string]bool, len(l.Redact)), patterns: l.RedactPatterns}
+	for _, name := range l.Redact {
+		r.names[name] = true
+	}
+	return r
+}
+
+func (r *redactor) matches(name string) bool {
+	if r.names[name] {
+		return true
+	}
+	for _, p := range r.patterns {
+		if p.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether there is anything to redact at all.
+func (r *redactor) active() bool {
+	return len(r.names) > 0 || len(r.patterns) > 0
+}
+
+/*
+Redact the values of matching attributes anywhere in a JSON body.
+
+Expression attribute values are only known by their placeholder. A value is
+redacted when the placeholder without its colon matches, which makes a
+placeholder like ":Email" work as you would hope, and also when it is used
+in an expression which refers to a matching attribute, directly or through
+an expression attribute name. The expressions aren't parsed any further, so
+this errs towards redacting every value in such an expression.
+*/
+func (r *redactor) redact(body []byte) []byte {
+	if !r.active() {
+		return body
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if dec.Decode(&v) != nil {
+		return body
+	}
+	out, err := json.Marshal(r.walk(v))
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+func (r *redactor) walk(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if values, ok := v["ExpressionAttributeValues"].(map[string]interface{}); ok {
+			sensitive := r.placeholders(v)
+			for k, inner := range values {
+				if sensitive[k] || r.matches(strings.TrimPrefix(k, ":")) {
+					values[k] = redactValue(inner)
+				}
+			}
+		}
+		for k, inner := range v {
+			if r.matches(k) {
+				v[k] = redactValue(inner)
+			} else {
+				v[k] = r.walk(inner)
+			}
+		}
+	case []interface{}:
+		for i, inner := range v {
+			v[i] = r.walk(inner)
+		}
+	}
+	return v
+}
+
+// Names, #name placeholders and :value placeholders in an expression.
+var expressionToken = regexp.MustCompile(`[#:]?[A-Za-z0-9_]+`)
+
+/*
+Find the value placeholders used in the request's expressions alongside a
+matching attribute.
+*/
+func (r *redactor) placeholders(request map[string]interface{}) map[string]bool {
+	names, _ := request["ExpressionAttributeNames"].(map[string]interface{})
+	sensitive := make(map[string]bool)
+	for field, expr := range request {
+		expr, ok := expr.(string)
+		if !ok || !strings.HasSuffix(field, "Expression") {
+			continue
+		}
+		tokens := expressionToken.FindAllString(expr, -1)
+		matched := false
+		for _, token := range tokens {
+			name := token
+			if strings.HasPrefix(token, "#") {
+				name, _ = names[token].(string)
+			}
+			if !strings.HasPrefix(token, ":") && r.matches(name) {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+		for _, token := range tokens {
+			if strings.HasPrefix(token, ":") {
+				sensitive[token] = true
+			}
+		}
+	}
+	return sensitive
+}
+
+// Keep the DynamoDB type wrapper, so the body still reads naturally.
+func redactValue(v interface{}) interface{} {
+	if m, ok := v.(map[string]interface{}); ok && len(m) == 1 {
+		for typ := range m {
+			return map[string]interface{}{typ: redacted}
+		}
+	}
+	return redacted
+}
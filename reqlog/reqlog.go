@@ -0,0 +1,166 @@
+/*
+package reqlog logs every DynamoDB request going through an executor.
+
+Each request is logged with its target, tables, latency, retry attempt,
+error type and response size, through a small structured Logger interface.
+Request and response bodies can be logged too, with the values of sensitive
+attributes redacted.
+
+Usage:
+
+	l := &reqlog.RequestLogger{
+		Logger:    reqlog.StdLogger(log.New(os.Stderr, "", log.LstdFlags)),
+		LogBodies: true,
+		Redact:    []string{"Email", "Token"},
+	}
+	l.Install(executor)
+
+To log each try of a retried request, install the logger inside the
+AutoRetry layer; the attempt number is then picked up automatically.
+*/
+package reqlog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/crast/dynatools/internal"
+	"github.com/crast/dynatools/middleware"
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+/*
+Logger is a structured logger.
+
+keyvals alternate between string keys and values of any type. The Info
+method of a *slog.Logger can be used through LoggerFunc.
+*/
+type Logger interface {
+	Log(msg string, keyvals ...interface{})
+}
+
+// LoggerFunc adapts an ordinary function into a Logger.
+type LoggerFunc func(msg string, keyvals ...interface{})
+
+func (f LoggerFunc) Log(msg string, keyvals ...interface{}) {
+	f(msg, keyvals...)
+}
+
+// StdLogger makes a Logger which writes key=value lines to a standard logger.
+func StdLogger(l *log.Logger) Logger {
+	return LoggerFunc(func(msg string, keyvals ...interface{}) {
+		var buf strings.Builder
+		buf.WriteString(msg)
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			fmt.Fprintf(&buf, " %v=%v", keyvals[i], keyvals[i+1])
+		}
+		l.Print(buf.String())
+	})
+}
+
+/*
+RequestLogger is an AwsRequester which logs every request made through it.
+
+All the settings besides Logger are optional, and must not be changed once
+requests are flowing through it.
+*/
+type RequestLogger struct {
+	Requester dynago.AwsRequester
+	Logger    Logger
+
+	ErrorsOnly bool // Only log requests which failed
+	LogBodies  bool // Also log the (redacted) request and response bodies
+
+	// Attribute names whose values are replaced in logged bodies. While
+	// anything is redacted, validation error messages, which can quote
+	// values, are replaced too.
+	Redact []string
+	// Attribute names matching any of these patterns are redacted as well.
+	RedactPatterns []*regexp.Regexp
+}
+
+func (l *RequestLogger) MakeRequest(target string, body []byte) ([]byte, error) {
+	return l.makeRequest(context.Background(), l.Requester, target, body)
+}
+
+// MakeRequestContext is like MakeRequest, passing ctx on to the wrapped requester.
+func (l *RequestLogger) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return l.makeRequest(ctx, l.Requester, target, body)
+}
+
+// Middleware returns a layer which logs requests using this RequestLogger's settings.
+func (l *RequestLogger) Middleware() middleware.Middleware {
+	return func(next dynago.AwsRequester) dynago.AwsRequester {
+		return &layer{l, next}
+	}
+}
+
+// Install to the executor as the "reqlog" layer of its middleware chain.
+func (l *RequestLogger) Install(executor *dynago.AwsExecutor) {
+	middleware.Install(executor).Use(Name, l.Middleware())
+}
+
+// The name RequestLogger uses for itself in a middleware chain.
+const Name = "reqlog"
+
+func (l *RequestLogger) makeRequest(ctx context.Context, requester dynago.AwsRequester, target string, body []byte) ([]byte, error) {
+	start := time.Now()
+	response, err := internal.MakeRequest(ctx, requester, target, body)
+	latency := time.Since(start)
+	if err == nil && l.ErrorsOnly {
+		return response, err
+	}
+
+	keyvals := []interface{}{
+		"target", target,
+		"table", strings.Join(internal.TableNames(body), ","),
+		"latency", latency,
+		"attempt", internal.AttemptFrom(ctx),
+		"responseSize", len(response),
+	}
+	r := l.redactor()
+	msg := "dynamo request"
+	if err != nil {
+		msg = "dynamo request failed"
+		// Validation messages may quote values from the request, so are
+		// only logged when nothing is being redacted.
+		text := err.Error()
+		if e := internal.AssertError(err); r.active() && e != nil && e.Type == dynago.ErrorValidation {
+			text = redacted
+		}
+		keyvals = append(keyvals, "errorType", ErrorType(err), "error", text)
+	}
+	if l.LogBodies {
+		keyvals = append(keyvals, "request", string(r.redact(body)))
+		if len(response) > 0 {
+			keyvals = append(keyvals, "response", string(r.redact(response)))
+		}
+	}
+	l.Logger.Log(msg, keyvals...)
+	return response, err
+}
+
+/*
+ErrorType describes the kind of an error for logging: Amazon's name for the
+error when it's a dynago error, otherwise the Go type of the error.
+*/
+func ErrorType(err error) string {
+	return internal.ErrorType(err)
+}
+
+type layer struct {
+	logger *RequestLogger
+	next   dynago.AwsRequester
+}
+
+func (l *layer) MakeRequest(target string, body []byte) ([]byte, error) {
+	return l.logger.makeRequest(context.Background(), l.next, target, body)
+}
+
+func (l *layer) MakeRequestContext(ctx context.Context, target string, body []byte) ([]byte, error) {
+	return l.logger.makeRequest(ctx, l.next, target, body)
+}
@@ -0,0 +1,109 @@
+package reqlog
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/underarmour/dynago.v1"
+)
+
+type entry struct {
+	msg    string
+	fields map[string]interface{}
+}
+
+func collect(entries *[]entry) Logger {
+	return LoggerFunc(func(msg string, keyvals ...interface{}) {
+		e := entry{msg, map[string]interface{}{}}
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			e.fields[keyvals[i].(string)] = keyvals[i+1]
+		}
+		*entries = append(*entries, e)
+	})
+}
+
+type fakeRequester struct {
+	err error
+}
+
+func (f *fakeRequester) MakeRequest(target string, body []byte) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return []byte(`{"Item":{"Id":{"N":"1"},"Email":{"S":"bob@example.com"}}}`), nil
+}
+
+func TestRequestLogger(t *testing.T) {
+	var entries []entry
+	requester := &fakeRequester{}
+	l := &RequestLogger{
+		Requester:      requester,
+		Logger:         collect(&entries),
+		LogBodies:      true,
+		Redact:         []string{"Email"},
+		RedactPatterns: []*regexp.Regexp{regexp.MustCompile("(?i)token")},
+	}
+	l.MakeRequest("DynamoDB_20120810.GetItem", []byte(`{"TableName":"people","Key":{"Id":{"N":"1"}},
+		"ExpressionAttributeValues":{":AuthToken":{"S":"secret"}}}`))
+	requester.err = &dynago.Error{Type: dynago.ErrorThrottling, AmazonRawType: "ThrottlingException"}
+	l.MakeRequest("DynamoDB_20120810.GetItem", []byte(`{"TableName":"people"}`))
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	first := entries[0].fields
+	if first["table"] != "people" || first["target"] != "DynamoDB_20120810.GetItem" {
+		t.Errorf("Unexpected fields %v", first)
+	}
+	for _, body := range []string{first["request"].(string), first["response"].(string)} {
+		if strings.Contains(body, "secret") || strings.Contains(body, "bob@example.com") {
+			t.Errorf("Expected body to be redacted: %s", body)
+		}
+	}
+	if !strings.Contains(first["response"].(string), `"Email":{"S":"REDACTED"}`) {
+		t.Errorf("Expected redacted Email to keep its type: %s", first["response"])
+	}
+	if entries[1].fields["errorType"] != "ThrottlingException" {
+		t.Errorf("Expected ThrottlingException, got %v", entries[1].fields["errorType"])
+	}
+}
+
+func TestErrorType(t *testing.T) {
+	if s := ErrorType(errors.New("x")); s != "*errors.errorString" {
+		t.Errorf("Unexpected error type %s", s)
+	}
+	if s := ErrorType(fmt.Errorf("wrapped: %w", errors.New("x"))); s != "*fmt.wrapError" {
+		t.Errorf("Unexpected error type %s", s)
+	}
+}
+
+func TestRedactPlaceholders(t *testing.T) {
+	var entries []entry
+	requester := &fakeRequester{err: &dynago.Error{Type: dynago.ErrorValidation, Message: "bad value bob@example.com"}}
+	l := &RequestLogger{Requester: requester, Logger: collect(&entries), LogBodies: true, Redact: []string{"Email"}}
+	l.MakeRequest("DynamoDB_20120810.Query", []byte(`{"TableName":"people",
+		"KeyConditionExpression":"#e = :v","ExpressionAttributeNames":{"#e":"Email"},
+		"FilterExpression":"Age > :a","ExpressionAttributeValues":{":v":{"S":"bob@example.com"},":a":{"N":"30"}}}`))
+
+	fields := entries[0].fields
+	request := fields["request"].(string)
+	if strings.Contains(request, "bob@example.com") || !strings.Contains(request, `":v":{"S":"REDACTED"}`) {
+		t.Errorf("Expected the value bound to #e to be redacted: %s", request)
+	}
+	if !strings.Contains(request, `":a":{"N":"30"}`) {
+		t.Errorf("Expected unrelated values to be kept: %s", request)
+	}
+	if fields["error"] != "REDACTED" {
+		t.Errorf("Expected the error message to be redacted, got %v", fields["error"])
+	}
+
+	// Other errors don't quote values, so are kept.
+	requester.err = &dynago.Error{Type: dynago.ErrorThroughputExceeded, Message: "slow down"}
+	l.MakeRequest("DynamoDB_20120810.Query", []byte(`{"TableName":"people"}`))
+	if text := entries[1].fields["error"].(string); !strings.Contains(text, "slow down") {
+		t.Errorf("Expected the throttling message to be kept, got %v", text)
+	}
+}
@@ -1,7 +1,7 @@
 package streamer
 
 import (
-	"gopkg.in/underarmour/dynago.v1"
+	"github.com/crast/dynatools/internal"
 	"gopkg.in/underarmour/dynago.v1/streams"
 	"log"
 	"sync"
@@ -219,14 +219,10 @@ func (s *StreamerShard) Consume() <-chan Update {
 				timeout = adjustFaster
 			}
 		} else {
-			if e, ok := err.(*dynago.Error); ok {
-				switch e.Type {
-				case dynago.ErrorThrottling, dynago.ErrorThroughputExceeded, dynago.ErrorInternalFailure:
-					return timeout + time.Second
-				case dynago.ErrorExpiredIterator, dynago.ErrorTrimmedData:
-					// TODO determine what we do on an expired iterator
-				}
+			if internal.IsThrottle(err) || internal.IsServiceError(err) {
+				return timeout + time.Second
 			}
+			// TODO determine what we do on an expired iterator or trimmed data
 			ch <- Update{
 				Timeout: timeout,
 				Error:   err,
@@ -0,0 +1,208 @@
+/*
+package tracing records spans around DynamoDB operations.
+
+A Tracer creates spans and hands every finished span to an Exporter. AutoRetry
+and bulk.BulkWriter both accept a Tracer, recording a span for each operation
+with a child span for each attempt at it, along with the table name and the
+type of any error.
+
+The bundled MemoryExporter keeps spans in memory so tests can make assertions
+about them; other tracing backends plug in by implementing Exporter.
+
+A nil *Tracer is valid and records nothing, as is the nil *Span it returns.
+
+Usage:
+
+	exporter := &tracing.MemoryExporter{}
+	retry := &autoretry.AutoRetry{MaxRetries: 5, Tracer: &tracing.Tracer{Exporter: exporter}}
+	// ... make requests ...
+	for _, span := range exporter.Spans() {
+		log.Printf("%s took %v", span.Name, span.Duration())
+	}
+*/
+package tracing
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Standard attribute keys.
+const (
+	AttrTarget    = "dynamo.target"
+	AttrTable     = "dynamo.table"
+	AttrAttempt   = "dynamo.attempt" // Always an int, starting from 1
+	AttrErrorType = "error.type"
+)
+
+// Exporter receives every span once it has ended.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// Tracer creates spans, sending them to Exporter when they end.
+type Tracer struct {
+	Exporter Exporter
+}
+
+type spanKey struct{}
+
+/*
+Start a span, as a child of the span in ctx if there is one.
+
+The returned context carries the new span, for starting children of it.
+*/
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		Name:      name,
+		SpanID:    newID(),
+		StartTime: time.Now(),
+		tracer:    t,
+	}
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = newID()
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Span is a single timed operation.
+type Span struct {
+	Name      string
+	TraceID   uint64 // Shared by every span in the same trace
+	SpanID    uint64
+	ParentID  uint64 // Zero for the root span of a trace
+	StartTime time.Time
+	EndTime   time.Time
+	Err       error
+	Attrs     map[string]interface{}
+
+	tracer *Tracer
+	mu     sync.Mutex
+}
+
+// Set an attribute on the span.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]interface{})
+	}
+	s.Attrs[key] = value
+	s.mu.Unlock()
+}
+
+// Attr returns the value of an attribute, or nil.
+func (s *Span) Attr(key string) interface{} {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Attrs[key]
+}
+
+// End the span with the outcome of its operation, and export it.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.EndTime = time.Now()
+	s.Err = err
+	s.mu.Unlock()
+	if s.tracer.Exporter != nil {
+		s.tracer.Exporter.ExportSpan(s)
+	}
+}
+
+// Duration of the span, or zero if it has not ended.
+func (s *Span) Duration() time.Duration {
+	if s == nil || s.EndTime.IsZero() {
+		return 0
+	}
+	return s.EndTime.Sub(s.StartTime)
+}
+
+var idSource = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func newID() uint64 {
+	idSource.Lock()
+	defer idSource.Unlock()
+	for {
+		if id := idSource.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+/*
+MemoryExporter keeps every exported span in memory, in the order they ended.
+It is mainly meant for tests.
+*/
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (m *MemoryExporter) ExportSpan(span *Span) {
+	m.mu.Lock()
+	m.spans = append(m.spans, span)
+	m.mu.Unlock()
+}
+
+// Spans returns all the spans exported so far.
+func (m *MemoryExporter) Spans() []*Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Span(nil), m.spans...)
+}
+
+// Roots returns the exported spans which have no parent.
+func (m *MemoryExporter) Roots() []*Span {
+	return m.filter(func(s *Span) bool { return s.ParentID == 0 })
+}
+
+// Children returns the exported spans which are direct children of parent.
+func (m *MemoryExporter) Children(parent *Span) []*Span {
+	return m.filter(func(s *Span) bool {
+		return s.TraceID == parent.TraceID && s.ParentID == parent.SpanID
+	})
+}
+
+// Reset forgets all the spans exported so far.
+func (m *MemoryExporter) Reset() {
+	m.mu.Lock()
+	m.spans = nil
+	m.mu.Unlock()
+}
+
+func (m *MemoryExporter) filter(keep func(*Span) bool) []*Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var result []*Span
+	for _, s := range m.spans {
+		if keep(s) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
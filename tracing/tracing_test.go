@@ -0,0 +1,59 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParentAndChildren(t *testing.T) {
+	exporter := &MemoryExporter{}
+	tracer := &Tracer{Exporter: exporter}
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child1 := tracer.Start(ctx, "child1")
+	child1.End(errors.New("boom"))
+	_, child2 := tracer.Start(ctx, "child2")
+	child2.SetAttr(AttrTable, "users")
+	child2.End(nil)
+	parent.End(nil)
+
+	if len(exporter.Spans()) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(exporter.Spans()))
+	}
+	roots := exporter.Roots()
+	if len(roots) != 1 || roots[0] != parent {
+		t.Fatalf("Expected parent as the only root, got %v", roots)
+	}
+	children := exporter.Children(parent)
+	if len(children) != 2 || children[0] != child1 || children[1] != child2 {
+		t.Fatalf("Unexpected children %v", children)
+	}
+	if child1.TraceID != parent.TraceID || child1.ParentID != parent.SpanID {
+		t.Errorf("Child not linked to parent")
+	}
+	if child1.Err == nil || child2.Attr(AttrTable) != "users" {
+		t.Errorf("Span details not recorded")
+	}
+	if parent.EndTime.Before(parent.StartTime) {
+		t.Errorf("End before start")
+	}
+
+	exporter.Reset()
+	if len(exporter.Spans()) != 0 {
+		t.Errorf("Expected no spans after Reset")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "op")
+	if span != nil || FromContext(ctx) != nil {
+		t.Fatalf("Expected no span from a nil tracer")
+	}
+	span.SetAttr("a", 1)
+	span.End(nil)
+	if span.Duration() != 0 {
+		t.Errorf("Expected zero duration")
+	}
+}